@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/status"
 
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
@@ -30,6 +31,9 @@ import (
 const (
 	ct  = "Content-Type"
 	typ = "application/x-protobuf"
+
+	// timeoutHeader carries the timeout of a request in seconds.
+	timeoutHeader = "X-Server-Timeout"
 )
 
 // Do is a helper for invoking grpc-fallback requests. It uses
@@ -38,8 +42,10 @@ const (
 // The given request protobuf is serialized and used as the payload.
 // A successful response is deserialized into the given response proto.
 // A non-2xx response status is returned as an error containing the
-// underlying gRPC status.
-func Do(address, serv, meth string, req, res proto.Message, hdr http.Header) error {
+// underlying gRPC status. The response headers and trailers, which carry
+// the backend's response metadata, are supplied to the grpc.Header and
+// grpc.Trailer call options, if any.
+func Do(address, serv, meth string, req, res proto.Message, hdr http.Header, opts ...grpc.CallOption) error {
 	// serialize msg payload
 	b, err := proto.Marshal(req)
 	if err != nil {
@@ -68,10 +74,13 @@ func Do(address, serv, meth string, req, res proto.Message, hdr http.Header) err
 		return err
 	}
 
+	defer response.Body.Close()
+
 	resBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return err
 	}
+	setCallMetadata(opts, response)
 
 	if response.StatusCode != http.StatusOK {
 		stpb := &statuspb.Status{}
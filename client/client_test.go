@@ -19,13 +19,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/gorilla/mux"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -72,6 +75,26 @@ func TestDo(t *testing.T) {
 	}
 }
 
+func TestDo_metadata(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc(fmt.Sprintf("/$rpc/%s/%s", testServiceName, testMethodNameOK), handleOK)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var header, trailer metadata.MD
+	if err := Do(ts.URL, testServiceName, testMethodNameOK, &empty.Empty{}, &empty.Empty{}, nil, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+		t.Fatalf("Do(): %v", err)
+	}
+
+	if got := header.Get("x-test-header"); !reflect.DeepEqual(got, []string{"value"}) {
+		t.Errorf("Do() header: got = %v, want = %v", got, []string{"value"})
+	}
+	if got := trailer.Get("x-test-trailer"); !reflect.DeepEqual(got, []string{"done"}) {
+		t.Errorf("Do() trailer: got = %v, want = %v", got, []string{"done"})
+	}
+}
+
 func handleOK(w http.ResponseWriter, r *http.Request) {
 	e := &empty.Empty{}
 
@@ -82,11 +105,14 @@ func handleOK(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// echo it back
+	// echo it back, along with response metadata
 	b, _ := proto.Marshal(e)
 
+	w.Header().Set("X-Test-Header", "value")
+	w.Header().Set("Trailer", "X-Test-Trailer")
 	w.WriteHeader(http.StatusOK)
 	w.Write(b)
+	w.Header().Set("X-Test-Trailer", "done")
 }
 
 func handleError(w http.ResponseWriter, r *http.Request) {
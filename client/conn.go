@@ -0,0 +1,258 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// Conn is a grpc.ClientConnInterface that invokes RPCs via grpc-fallback,
+// so that generated gRPC clients can be used with a grpc-fallback server:
+//
+//	conn := client.NewConn("http://localhost:1337")
+//	echo := showpb.NewEchoClient(conn)
+//
+// Unary, server-streaming and client-streaming RPCs are supported, while
+// bidirectional streaming RPCs fail with an Unimplemented status.
+type Conn struct {
+	address string
+	client  *http.Client
+	header  http.Header
+}
+
+var _ grpc.ClientConnInterface = (*Conn)(nil)
+
+// ConnOption customizes a Conn created by NewConn.
+type ConnOption func(*Conn)
+
+// WithHTTPClient sends requests using the given HTTP client,
+// instead of the default one.
+func WithHTTPClient(c *http.Client) ConnOption {
+	return func(conn *Conn) {
+		conn.client = c
+	}
+}
+
+// WithHeader adds the given headers to every request.
+func WithHeader(hdr http.Header) ConnOption {
+	return func(conn *Conn) {
+		conn.header = hdr
+	}
+}
+
+// NewConn creates a Conn for the grpc-fallback server at the given
+// address, which includes the scheme, e.g. "http://localhost:1337".
+func NewConn(address string, opts ...ConnOption) *Conn {
+	c := &Conn{
+		address: strings.TrimSuffix(address, "/"),
+		client:  http.DefaultClient,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Invoke sends the request message in a grpc-fallback request, and
+// deserializes the response into reply. Outgoing metadata in the context
+// is sent as request headers. The response headers and trailers are
+// supplied to the grpc.Header and grpc.Trailer call options, if any.
+func (c *Conn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	req, ok := args.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "request of type %T is not a protobuf message", args)
+	}
+	res, ok := reply.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "response of type %T is not a protobuf message", reply)
+	}
+
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return status.Errorf(codes.Internal, "error serializing request: %v", err)
+	}
+
+	response, err := c.do(ctx, method, typ, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	resBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return toStatusError(ctx, err)
+	}
+	setCallMetadata(opts, response)
+
+	if response.StatusCode != http.StatusOK {
+		return responseError(response.StatusCode, resBody)
+	}
+
+	if err := proto.Unmarshal(resBody, res); err != nil {
+		return status.Errorf(codes.Internal, "error deserializing response: %v", err)
+	}
+
+	return nil
+}
+
+// do sends a grpc-fallback request for the given full method name,
+// in the "/package.Service/Method" form used by generated clients,
+// with a body of the given content type.
+func (c *Conn) do(ctx context.Context, method, contentType string, body io.Reader) (*http.Response, error) {
+	parts := strings.Split(strings.TrimPrefix(method, "/"), "/")
+	if len(parts) != 2 {
+		return nil, status.Errorf(codes.InvalidArgument, "malformed method name %q", method)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, buildURL(c.address, parts[0], parts[1]), body)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error creating request: %v", err)
+	}
+	request = request.WithContext(ctx)
+
+	for k, v := range c.header {
+		request.Header[k] = append([]string(nil), v...)
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		setHeaders(request.Header, md)
+	}
+	request.Header.Set(ct, contentType)
+
+	// let the server bound its backend call by the deadline of the RPC
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout < 0 {
+			timeout = 0
+		}
+		request.Header.Set(timeoutHeader, strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, toStatusError(ctx, err)
+	}
+
+	return response, nil
+}
+
+// NewStream begins a streaming RPC. The requests of a client-streaming RPC
+// are sent as a length-delimited request body, and the responses of a
+// server-streaming RPC are read from a length-prefixed response stream.
+// Bidirectional streaming RPCs are not supported, because a grpc-fallback
+// response is only sent once the request body has been received in full.
+func (c *Conn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if desc.ClientStreams && desc.ServerStreams {
+		return nil, status.Errorf(codes.Unimplemented, "bidirectional streaming method %s is not supported by grpc-fallback", method)
+	}
+
+	return newStream(ctx, c, desc, method, opts), nil
+}
+
+// setHeaders adds the given metadata to the request headers,
+// base64 encoding the values of binary "-bin" keys.
+func setHeaders(hdr http.Header, md metadata.MD) {
+	for k, vs := range md {
+		for _, v := range vs {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			hdr.Add(k, v)
+		}
+	}
+}
+
+// headerMetadata converts HTTP headers into metadata, decoding
+// the base64 encoded values of binary "-bin" keys.
+func headerMetadata(hdr http.Header) metadata.MD {
+	md := make(metadata.MD, len(hdr))
+	for k, vs := range hdr {
+		k = strings.ToLower(k)
+		for _, v := range vs {
+			if strings.HasSuffix(k, "-bin") {
+				if b, err := decodeBinary(v); err == nil {
+					v = string(b)
+				}
+			}
+			md.Append(k, v)
+		}
+	}
+
+	return md
+}
+
+// decodeBinary decodes a base64 value, with or without padding.
+func decodeBinary(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+// setCallMetadata supplies the response headers and trailers to
+// the grpc.Header and grpc.Trailer call options, if any.
+func setCallMetadata(opts []grpc.CallOption, response *http.Response) {
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case grpc.HeaderCallOption:
+			*o.HeaderAddr = headerMetadata(response.Header)
+		case grpc.TrailerCallOption:
+			*o.TrailerAddr = headerMetadata(response.Trailer)
+		}
+	}
+}
+
+// responseError converts a failed grpc-fallback response into an error,
+// carrying the serialized google.rpc.Status in the body, if any.
+func responseError(code int, body []byte) error {
+	stpb := &statuspb.Status{}
+	if err := proto.Unmarshal(body, stpb); err != nil || stpb.GetCode() == 0 {
+		return status.Errorf(codes.Unknown, "unexpected HTTP status %d: %s", code, body)
+	}
+
+	return status.FromProto(stpb).Err()
+}
+
+// toStatusError converts an error sending a request into a status error,
+// reporting context errors as such.
+func toStatusError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return status.Error(codes.Canceled, ctx.Err().Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+
+	return status.Error(codes.Unavailable, fmt.Sprintf("error sending request: %v", err))
+}
@@ -0,0 +1,273 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+)
+
+// testServer is a fake grpc-fallback server for the health and interop test services.
+func testServer(t *testing.T) *httptest.Server {
+	r := mux.NewRouter()
+	r.HandleFunc("/$rpc/grpc.health.v1.Health/Check", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := &healthpb.HealthCheckRequest{}
+		proto.Unmarshal(body, req)
+
+		if req.GetService() == "error" {
+			handleError(w, r)
+			return
+		}
+
+		// echo the request metadata back as response metadata
+		w.Header().Set("Trailer", "X-Test-Trailer")
+		w.Header().Set("X-Test-Header", r.Header.Get("X-Test-Header"))
+		w.Header().Set("X-Test-Header-Bin", r.Header.Get("X-Test-Header-Bin"))
+		w.Header().Set("X-Test-Timeout", r.Header.Get("X-Server-Timeout"))
+		b, _ := proto.Marshal(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+		w.Write(b)
+		w.Header().Set("X-Test-Trailer", "done")
+	})
+	r.HandleFunc("/$rpc/grpc.health.v1.Health/Watch", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := &healthpb.HealthCheckRequest{}
+		proto.Unmarshal(body, req)
+
+		w.Header().Set("Content-Type", streamType)
+		w.Header().Set("X-Test-Timeout", r.Header.Get("X-Server-Timeout"))
+		for _, st := range []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING} {
+			b, _ := proto.Marshal(&healthpb.HealthCheckResponse{Status: st})
+			writeFrame(w, messageFrame, b)
+		}
+
+		st := status.New(codes.OK, "")
+		if req.GetService() == "fail" {
+			st = status.New(codes.Internal, "failed")
+		}
+		b, _ := proto.Marshal(st.Proto())
+		writeFrame(w, statusFrame, b)
+	})
+	r.HandleFunc("/$rpc/grpc.testing.TestService/StreamingInputCall", func(w http.ResponseWriter, r *http.Request) {
+		size := 0
+		br := bufio.NewReader(r.Body)
+		for {
+			n, err := binary.ReadUvarint(br)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("error reading request length: %v", err)
+				return
+			}
+
+			b := make([]byte, n)
+			io.ReadFull(br, b)
+			req := &testpb.StreamingInputCallRequest{}
+			if err := proto.Unmarshal(b, req); err != nil {
+				t.Errorf("error reading request: %v", err)
+			}
+			size += len(req.GetPayload().GetBody())
+		}
+
+		b, _ := proto.Marshal(&testpb.StreamingInputCallResponse{AggregatedPayloadSize: int32(size)})
+		w.Write(b)
+	}).Headers("Content-Type", streamType)
+
+	s := httptest.NewServer(r)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func writeFrame(w io.Writer, flag byte, b []byte) {
+	hdr := make([]byte, 5)
+	hdr[0] = flag
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+	w.Write(hdr)
+	w.Write(b)
+}
+
+func TestConn_Invoke(t *testing.T) {
+	s := testServer(t)
+	client := healthpb.NewHealthClient(NewConn(s.URL))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-test-header", "value", "x-test-header-bin", "\x00\x01")
+	var header, trailer metadata.MD
+	res, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("Conn.Invoke(): %v", err)
+	}
+
+	if res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Conn.Invoke() response: got = %v, want = %v", res.GetStatus(), healthpb.HealthCheckResponse_SERVING)
+	}
+	if got := header.Get("x-test-header"); !reflect.DeepEqual(got, []string{"value"}) {
+		t.Errorf("Conn.Invoke() header: got = %v, want = %v", got, []string{"value"})
+	}
+	if got := header.Get("x-test-header-bin"); !reflect.DeepEqual(got, []string{"\x00\x01"}) {
+		t.Errorf("Conn.Invoke() binary header: got = %q, want = %q", got, []string{"\x00\x01"})
+	}
+	if got := trailer.Get("x-test-trailer"); !reflect.DeepEqual(got, []string{"done"}) {
+		t.Errorf("Conn.Invoke() trailer: got = %v, want = %v", got, []string{"done"})
+	}
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "error"})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("Conn.Invoke() error: got = %v, want = %v", err, codes.InvalidArgument)
+	}
+
+	err = NewConn(s.URL).Invoke(context.Background(), "/grpc.health.v1.Health/Unknown", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+	if code := status.Code(err); code != codes.Unknown {
+		t.Errorf("Conn.Invoke() unknown method: got = %v, want = %v", err, codes.Unknown)
+	}
+}
+
+func TestConn_timeout(t *testing.T) {
+	s := testServer(t)
+	client := healthpb.NewHealthClient(NewConn(s.URL))
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		stream  bool
+	}{
+		{name: "unary"},
+		{name: "unary deadline", timeout: 5 * time.Second},
+		{name: "stream", stream: true},
+		{name: "stream deadline", timeout: 5 * time.Second, stream: true},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+			defer cancel()
+		}
+
+		var header metadata.MD
+		var err error
+		if tt.stream {
+			var stream healthpb.Health_WatchClient
+			if stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{}); err == nil {
+				header, err = stream.Header()
+			}
+		} else {
+			_, err = client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+		}
+		if err != nil {
+			t.Fatalf("Conn timeout %s: %v", tt.name, err)
+		}
+
+		var got string
+		if v := header.Get("x-test-timeout"); len(v) > 0 {
+			got = v[0]
+		}
+		if tt.timeout == 0 {
+			if got != "" {
+				t.Errorf("Conn timeout %s: got = %s, want none", tt.name, got)
+			}
+			continue
+		}
+		if s, err := strconv.ParseFloat(got, 64); err != nil || s <= 0 || s > tt.timeout.Seconds() {
+			t.Errorf("Conn timeout %s: got = %q, want at most %v", tt.name, got, tt.timeout)
+		}
+	}
+}
+
+func TestConn_NewStream(t *testing.T) {
+	s := testServer(t)
+	conn := NewConn(s.URL)
+
+	tests := []struct {
+		name     string
+		service  string
+		want     []healthpb.HealthCheckResponse_ServingStatus
+		wantCode codes.Code
+	}{
+		{name: "basic", want: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING}},
+		{name: "error after responses", service: "fail", want: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING}, wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{Service: tt.service})
+			if err != nil {
+				t.Fatalf("Conn.NewStream() %s: %v", tt.name, err)
+			}
+
+			var got []healthpb.HealthCheckResponse_ServingStatus
+			for {
+				res, err := stream.Recv()
+				if err != nil {
+					if err == io.EOF {
+						err = nil
+					}
+					if code := status.Code(err); code != tt.wantCode {
+						t.Errorf("Conn.NewStream() %s code: got = %v, want = %v", tt.name, err, tt.wantCode)
+					}
+					break
+				}
+				got = append(got, res.GetStatus())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Conn.NewStream() %s: got = %v, want = %v", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("client streaming", func(t *testing.T) {
+		stream, err := testpb.NewTestServiceClient(conn).StreamingInputCall(context.Background())
+		if err != nil {
+			t.Fatalf("Conn.NewStream() client streaming: %v", err)
+		}
+		for _, body := range []string{"a", "bb", "ccc"} {
+			if err := stream.Send(&testpb.StreamingInputCallRequest{Payload: &testpb.Payload{Body: []byte(body)}}); err != nil {
+				t.Fatalf("Conn.NewStream() client streaming send: %v", err)
+			}
+		}
+
+		res, err := stream.CloseAndRecv()
+		if err != nil || res.GetAggregatedPayloadSize() != 6 {
+			t.Errorf("Conn.NewStream() client streaming: got = %v (%v), want = %d", res, err, 6)
+		}
+	})
+
+	t.Run("bidi streaming", func(t *testing.T) {
+		_, err := testpb.NewTestServiceClient(conn).FullDuplexCall(context.Background())
+		if code := status.Code(err); code != codes.Unimplemented {
+			t.Errorf("Conn.NewStream() bidi streaming: got = %v, want = %v", err, codes.Unimplemented)
+		}
+	})
+}
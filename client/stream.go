@@ -0,0 +1,265 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+const (
+	// streamType is the content type of a streamed response made
+	// up of length-prefixed protobuf frames, and of a streamed request
+	// made up of length-delimited messages
+	streamType = "application/x-protobuf-stream"
+
+	// flags marking the payload of a length-prefixed frame
+	messageFrame byte = 0x00
+	statusFrame  byte = 0x80
+)
+
+// stream is a grpc.ClientStream for a single grpc-fallback request.
+// Request messages are written to the request body as they are sent,
+// and the response is read once the sending side has been closed.
+type stream struct {
+	ctx  context.Context
+	desc *grpc.StreamDesc
+	opts []grpc.CallOption
+
+	// the sending side of the request body
+	pw   *io.PipeWriter
+	sent int
+
+	// done is closed once the response headers have arrived
+	done     chan struct{}
+	response *http.Response
+	err      error
+
+	body     *bufio.Reader
+	received int
+	finished bool
+}
+
+func newStream(ctx context.Context, c *Conn, desc *grpc.StreamDesc, method string, opts []grpc.CallOption) *stream {
+	pr, pw := io.Pipe()
+	s := &stream{
+		ctx:  ctx,
+		desc: desc,
+		opts: opts,
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+
+	contentType := typ
+	if desc.ClientStreams {
+		contentType = streamType
+	}
+
+	go func() {
+		defer close(s.done)
+		s.response, s.err = c.do(ctx, method, contentType, pr)
+
+		// unblock senders if the request failed early
+		pr.CloseWithError(io.ErrClosedPipe)
+	}()
+
+	return s
+}
+
+func (s *stream) Header() (metadata.MD, error) {
+	<-s.done
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return headerMetadata(s.response.Header), nil
+}
+
+func (s *stream) Trailer() metadata.MD {
+	if !s.finished || s.response == nil {
+		return nil
+	}
+
+	return headerMetadata(s.response.Trailer)
+}
+
+func (s *stream) CloseSend() error {
+	return s.pw.Close()
+}
+
+func (s *stream) Context() context.Context {
+	return s.ctx
+}
+
+// SendMsg writes a request message to the request body. The messages of
+// client-streaming RPCs are length-delimited, while the single message of
+// other RPCs makes up the whole body.
+func (s *stream) SendMsg(m interface{}) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "request of type %T is not a protobuf message", m)
+	}
+	if !s.desc.ClientStreams && s.sent > 0 {
+		return status.Error(codes.Internal, "cannot send multiple requests on a server-streaming RPC")
+	}
+
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return status.Errorf(codes.Internal, "error serializing request: %v", err)
+	}
+
+	if s.desc.ClientStreams {
+		n := make([]byte, binary.MaxVarintLen64)
+		b = append(n[:binary.PutUvarint(n, uint64(len(b)))], b...)
+	}
+
+	// the response is available to RecvMsg if the request failed
+	if _, err := s.pw.Write(b); err != nil {
+		return io.EOF
+	}
+	s.sent++
+
+	return nil
+}
+
+// RecvMsg reads a response message, waiting for the response to arrive.
+func (s *stream) RecvMsg(m interface{}) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "response of type %T is not a protobuf message", m)
+	}
+
+	<-s.done
+	if s.err != nil {
+		return s.err
+	}
+	if s.finished {
+		return io.EOF
+	}
+
+	err := s.recv(msg)
+	if err != nil {
+		s.finish()
+	}
+
+	return err
+}
+
+func (s *stream) recv(msg proto.Message) error {
+	if s.body == nil {
+		s.body = bufio.NewReader(s.response.Body)
+		setCallMetadata(s.opts, s.response)
+	}
+
+	if s.response.StatusCode != http.StatusOK {
+		b, err := ioutil.ReadAll(s.body)
+		if err != nil {
+			return toStatusError(s.ctx, err)
+		}
+		return responseError(s.response.StatusCode, b)
+	}
+
+	// the single response of a client-streaming RPC is the whole body
+	if !s.desc.ServerStreams {
+		if s.received > 0 {
+			return io.EOF
+		}
+
+		b, err := ioutil.ReadAll(s.body)
+		if err != nil {
+			return toStatusError(s.ctx, err)
+		}
+		if err := proto.Unmarshal(b, msg); err != nil {
+			return status.Errorf(codes.Internal, "error deserializing response: %v", err)
+		}
+		s.received++
+
+		// there are no more responses to receive
+		s.finish()
+		return nil
+	}
+
+	if got := s.response.Header.Get(ct); !strings.HasPrefix(got, streamType) {
+		return status.Errorf(codes.Internal, "unexpected response content type %q for a server-streaming RPC", got)
+	}
+
+	flag, b, err := readFrame(s.body)
+	if err != nil {
+		return toStatusError(s.ctx, err)
+	}
+
+	if flag == statusFrame {
+		stpb := &statuspb.Status{}
+		if err := proto.Unmarshal(b, stpb); err != nil {
+			return status.Errorf(codes.Internal, "error deserializing response status: %v", err)
+		}
+		if err := status.FromProto(stpb).Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return status.Errorf(codes.Internal, "error deserializing response: %v", err)
+	}
+	s.received++
+
+	return nil
+}
+
+// finish releases the response once the RPC is complete.
+func (s *stream) finish() {
+	if s.finished {
+		return
+	}
+	s.finished = true
+
+	// drain the body so that HTTP trailers become available
+	io.Copy(ioutil.Discard, s.body)
+	s.response.Body.Close()
+	setCallMetadata(s.opts, s.response)
+}
+
+// readFrame reads a single frame of a length-prefixed response stream.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+
+	return hdr[0], b, nil
+}
@@ -15,27 +15,396 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
 
 	fb "github.com/googleapis/grpc-fallback-go/server"
 )
 
 var (
-	port, addr string
+	port, addr     string
+	reflection     bool
+	rest           bool
+	descriptorSets stringList
+
+	// routes to other backends, by service
+	routeFlags stringList
+	routesFile string
+
+	// backends of other hosts
+	virtualHosts stringList
+
+	// CORS policy
+	corsOrigins, corsHeaders, corsExposedHeaders, corsMethods stringList
+	corsCredentials                                           bool
+	corsMaxAge                                                time.Duration
+
+	readHeaderTimeout, idleTimeout time.Duration
+	shutdownTimeout                time.Duration
+
+	// request header forwarding
+	forwardHeaders, forwardHeaderPrefixes, forwardHeaderPatterns stringList
+	dropHeaders, dropHeaderPrefixes, dropHeaderPatterns          stringList
+	renameHeaders                                                stringList
+
+	// response metadata
+	responseHeaderPrefix, responseTrailerPrefix string
+	responseTrailers                            bool
+
+	// readiness of backends
+	readinessHealthCheck bool
+	readinessService     string
+	readinessTimeout     time.Duration
+
+	// logging
+	logLevel, logFormat string
+	accessLog           bool
+
+	// Prometheus metrics and trace context propagation
+	metrics                  bool
+	metricsPath, metricsAddr string
+	tracing                  bool
+
+	// deadlines of backend calls
+	maxTimeout        time.Duration
+	methodMaxTimeouts stringList
+
+	// backend transport security
+	backendPlaintext, backendTLS                          bool
+	backendCA, backendCert, backendKey, backendServerName string
+
+	// listener TLS and HTTP/2
+	tlsCert, tlsKey, tlsClientCA string
+	tlsRequireClientCert         bool
+	h2c                          bool
 )
 
+// stringList is a flag that can be repeated, or given a
+// comma-separated list of values.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, strings.Split(v, ",")...)
+	return nil
+}
+
 func init() {
 	flag.StringVar(&port, "port", ":1337", "port for the fallback server to listen on")
-	flag.StringVar(&addr, "address", "", "address of the gRPC service backend")
+	flag.StringVar(&addr, "address", "", "address of the gRPC service backend, for services without a route")
+	flag.Var(&routeFlags, "route", "service=address pair routing a service, or package.* prefix, to another gRPC backend, may be repeated")
+	flag.Var(&virtualHosts, "virtual_host", "host=address pair proxying the requests for a host, or *.domain, to another gRPC backend, may be repeated")
+	flag.StringVar(&routesFile, "routes", "", "JSON file of routes to other gRPC backends, with their own transport security")
+	flag.BoolVar(&reflection, "reflection", false, "resolve service descriptors via the backend's server reflection API")
+	flag.Var(&descriptorSets, "descriptor_set", "FileDescriptorSet file to resolve service descriptors from, may be repeated")
+	flag.BoolVar(&rest, "rest", false, "route REST requests based on the google.api.http annotations of methods")
+	flag.Var(&corsOrigins, "cors_origin", "origin, or pattern with * wildcards, allowed to make cross-origin requests, may be repeated, defaults to any origin")
+	flag.Var(&corsHeaders, "cors_allowed_header", "request header allowed in cross-origin requests, may be repeated, defaults to any header")
+	flag.Var(&corsExposedHeaders, "cors_exposed_header", "response header exposed to cross-origin scripts, may be repeated")
+	flag.Var(&corsMethods, "cors_allowed_method", "method allowed in cross-origin requests, may be repeated, defaults to POST")
+	flag.BoolVar(&corsCredentials, "cors_allow_credentials", false, "allow cross-origin requests with credentials, from the origins of -cors_origin with the headers of -cors_allowed_header")
+	flag.DurationVar(&corsMaxAge, "cors_max_age", time.Hour, "time for which preflight responses may be cached")
+	flag.DurationVar(&readHeaderTimeout, "read_header_timeout", 10*time.Second, "time allowed to read request headers, zero for no limit")
+	flag.DurationVar(&idleTimeout, "idle_timeout", 2*time.Minute, "time to keep idle connections open, zero for no limit")
+	flag.DurationVar(&shutdownTimeout, "shutdown_timeout", 30*time.Second, "time allowed for in-flight requests to complete on SIGINT or SIGTERM")
+
+	flag.Var(&forwardHeaders, "forward_header", "request header to forward to the gRPC backend as metadata, may be repeated")
+	flag.Var(&forwardHeaderPrefixes, "forward_header_prefix", "prefix of request headers to forward to the gRPC backend, may be repeated")
+	flag.Var(&forwardHeaderPatterns, "forward_header_regexp", "regular expression matching request headers to forward to the gRPC backend, may be repeated")
+	flag.Var(&dropHeaders, "drop_header", "request header never to forward to the gRPC backend, may be repeated")
+	flag.Var(&dropHeaderPrefixes, "drop_header_prefix", "prefix of request headers never to forward to the gRPC backend, may be repeated")
+	flag.Var(&dropHeaderPatterns, "drop_header_regexp", "regular expression matching request headers never to forward to the gRPC backend, may be repeated")
+	flag.Var(&renameHeaders, "rename_header", "header=key pair forwarding a request header as the given metadata key, may be repeated")
+	flag.StringVar(&responseHeaderPrefix, "response_header_prefix", "", "prefix of the response headers carrying the gRPC backend's header metadata")
+	flag.StringVar(&responseTrailerPrefix, "response_trailer_prefix", "", "prefix of the response headers, or trailers, carrying the gRPC backend's trailer metadata")
+	flag.BoolVar(&responseTrailers, "response_trailers", false, "write the gRPC backend's trailer metadata as HTTP trailers")
+	flag.BoolVar(&readinessHealthCheck, "readiness_health_check", false, "require backends to report SERVING via grpc.health.v1.Health/Check to be ready")
+	flag.StringVar(&readinessService, "readiness_service", "", "service name to check the health of with -readiness_health_check, empty for the whole backend")
+	flag.DurationVar(&readinessTimeout, "readiness_timeout", time.Second, "time allowed to check the readiness of each backend")
+	flag.StringVar(&logLevel, "log_level", "info", "minimum level of log messages: debug, info, warn or error, with debug logging each request")
+	flag.StringVar(&logFormat, "log_format", "text", "format of log messages: text or json")
+	flag.BoolVar(&accessLog, "access_log", false, "write a JSON access log entry to stdout for each proxied request")
+	flag.BoolVar(&metrics, "metrics", false, "export Prometheus metrics of proxied requests and backend connections")
+	flag.StringVar(&metricsPath, "metrics_path", "/metrics", "path to serve the -metrics on")
+	flag.StringVar(&metricsAddr, "metrics_address", "", "address of a separate admin server for the -metrics, such as :9090, instead of the fallback server")
+	flag.BoolVar(&tracing, "tracing", false, "propagate W3C and B3 trace context from requests to the gRPC backend, within a span of the proxy")
+	flag.DurationVar(&maxTimeout, "max_timeout", 0, "longest timeout of backend calls, also applied to requests without one, zero for no limit")
+	flag.Var(&methodMaxTimeouts, "method_max_timeout", "Service/Method=duration pair overriding -max_timeout for a method, may be repeated")
+	flag.BoolVar(&backendPlaintext, "backend_plaintext", false, "connect to the gRPC backend without TLS")
+	flag.BoolVar(&backendTLS, "backend_tls", false, "connect to the gRPC backend with TLS, even on localhost")
+	flag.StringVar(&backendCA, "backend_ca", "", "PEM bundle of CAs to verify the gRPC backend's certificate, instead of the system's")
+	flag.StringVar(&backendCert, "backend_cert", "", "PEM client certificate for mutual TLS with the gRPC backend")
+	flag.StringVar(&backendKey, "backend_key", "", "PEM client key for mutual TLS with the gRPC backend")
+	flag.StringVar(&backendServerName, "backend_server_name", "", "name to verify in the gRPC backend's certificate, instead of its host")
+	flag.StringVar(&tlsCert, "tls_cert", "", "PEM certificate to serve HTTPS with, reloaded when it changes")
+	flag.StringVar(&tlsKey, "tls_key", "", "PEM key to serve HTTPS with, reloaded when it changes")
+	flag.StringVar(&tlsClientCA, "tls_client_ca", "", "PEM bundle of CAs to verify client certificates with")
+	flag.BoolVar(&tlsRequireClientCert, "tls_require_client_cert", false, "reject HTTPS clients without a verified certificate")
+	flag.BoolVar(&h2c, "h2c", false, "serve HTTP/2 to cleartext clients")
 
 	flag.Parse()
 
-	if addr == "" {
-		log.Fatalln("missing required flag -address")
+	if addr == "" && len(routeFlags) == 0 && routesFile == "" && len(virtualHosts) == 0 {
+		log.Fatalln("missing required flag -address, or -route, -routes or -virtual_host")
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatalln("flags -tls_cert and -tls_key must be given together")
+	}
+	if backendPlaintext && backendTLS {
+		log.Fatalln("flags -backend_plaintext and -backend_tls are mutually exclusive")
+	}
+	if corsCredentials && (len(corsOrigins) == 0 || containsWildcard(corsOrigins)) {
+		log.Fatalln("flag -cors_allow_credentials requires explicit -cors_origin origins or patterns")
+	}
+	if corsCredentials && (len(corsHeaders) == 0 || containsWildcard(corsHeaders)) {
+		log.Fatalln("flag -cors_allow_credentials requires explicit -cors_allowed_header headers")
+	}
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("invalid -log_format %q, want text or json", logFormat)
 	}
 }
 
 func main() {
-	fb.NewServer(port, addr).Start()
+	handler, err := logHandler()
+	if err != nil {
+		log.Fatalln("Error in logging flags:", err)
+	}
+	opts := []fb.Option{
+		fb.WithLogger(slog.New(handler)),
+		fb.WithHTTPServer(&http.Server{
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+			ErrorLog:          slog.NewLogLogger(handler, slog.LevelError),
+		}),
+	}
+	if accessLog {
+		opts = append(opts, fb.WithAccessLog(slog.New(slog.NewJSONHandler(os.Stdout, nil))))
+	}
+	if len(descriptorSets) > 0 {
+		src, err := fb.LoadDescriptorSets(descriptorSets...)
+		if err != nil {
+			log.Fatalln("Error loading -descriptor_set:", err)
+		}
+		opts = append(opts, fb.WithDescriptorSource(src))
+	}
+	if reflection {
+		opts = append(opts, fb.WithReflection(0))
+	}
+	if rest {
+		opts = append(opts, fb.WithRESTRoutes())
+	}
+	routes, err := backendRoutes()
+	if err != nil {
+		log.Fatalln("Error in routing flags:", err)
+	}
+	opts = append(opts, fb.WithRoutes(routes...))
+	for _, vh := range virtualHosts {
+		parts := strings.SplitN(vh, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("invalid -virtual_host %q, want host=address", vh)
+		}
+		opts = append(opts, fb.WithVirtualHost(parts[0], parts[1]))
+	}
+	headers, err := headerPolicy()
+	if err != nil {
+		log.Fatalln("Error in header forwarding flags:", err)
+	}
+	opts = append(opts, fb.WithHeaderPolicy(headers))
+	respMetadata := fb.DefaultResponseMetadataPolicy()
+	respMetadata.HeaderPrefix = responseHeaderPrefix
+	respMetadata.TrailerPrefix = responseTrailerPrefix
+	respMetadata.Trailers = responseTrailers
+	opts = append(opts, fb.WithResponseMetadata(respMetadata))
+	opts = append(opts, fb.WithReadinessPolicy(fb.ReadinessPolicy{
+		HealthCheck: readinessHealthCheck,
+		Service:     readinessService,
+		Timeout:     readinessTimeout,
+	}))
+	if metrics {
+		opts = append(opts, fb.WithMetrics(metricsPath, metricsAddr))
+	}
+	if tracing {
+		opts = append(opts, fb.WithTracing(fb.Tracing{}))
+	}
+	deadlines, err := deadlinePolicy()
+	if err != nil {
+		log.Fatalln("Error in timeout flags:", err)
+	}
+	opts = append(opts, fb.WithDeadlinePolicy(deadlines))
+	if backendPlaintext || backendTLS || backendCA != "" || backendCert != "" || backendKey != "" || backendServerName != "" {
+		opts = append(opts, fb.WithTransportSecurity(fb.TransportSecurity{
+			Plaintext:  backendPlaintext,
+			CAFile:     backendCA,
+			CertFile:   backendCert,
+			KeyFile:    backendKey,
+			ServerName: backendServerName,
+		}))
+	}
+	if tlsCert != "" {
+		opts = append(opts, fb.WithTLS(fb.ServerTLS{
+			CertFile:          tlsCert,
+			KeyFile:           tlsKey,
+			ClientCAFile:      tlsClientCA,
+			RequireClientCert: tlsRequireClientCert,
+		}))
+	}
+	if h2c {
+		opts = append(opts, fb.WithH2C())
+	}
+	cors := fb.DefaultCORSPolicy()
+	if len(corsOrigins) > 0 {
+		cors.AllowedOrigins = corsOrigins
+	}
+	if len(corsHeaders) > 0 {
+		cors.AllowedHeaders = corsHeaders
+	}
+	if len(corsMethods) > 0 {
+		cors.AllowedMethods = corsMethods
+	}
+	cors.ExposedHeaders = corsExposedHeaders
+	cors.AllowCredentials = corsCredentials
+	cors.MaxAge = corsMaxAge
+	opts = append(opts, fb.WithCORSPolicy(cors))
+
+	// drain in-flight requests on SIGINT or SIGTERM
+	s := fb.NewServer(port, addr, opts...)
+	stopped := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		stopped <- s.Shutdown(ctx)
+	}()
+
+	if err := s.Start(); err != http.ErrServerClosed {
+		log.Fatalln("Error in fallback server:", err)
+	}
+	if err := <-stopped; err != nil {
+		log.Fatalln("Error shutting down fallback server:", err)
+	}
+}
+
+// backendRoutes reads the routes of the -routes file, followed by those of the -route flags.
+func backendRoutes() ([]fb.Route, error) {
+	var routes []fb.Route
+	if routesFile != "" {
+		var err error
+		if routes, err = fb.LoadRoutes(routesFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range routeFlags {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid -route %q, want service=address", r)
+		}
+		routes = append(routes, fb.Route{Service: parts[0], Backend: parts[1]})
+	}
+
+	return routes, nil
+}
+
+// headerPolicy extends the default header forwarding policy with the flags.
+func headerPolicy() (fb.HeaderPolicy, error) {
+	p := fb.DefaultHeaderPolicy()
+	p.Allow = append(p.Allow, forwardHeaders...)
+	p.AllowPrefixes = append(p.AllowPrefixes, forwardHeaderPrefixes...)
+	p.Deny = dropHeaders
+	p.DenyPrefixes = dropHeaderPrefixes
+
+	var err error
+	if p.AllowPatterns, err = compileAll(forwardHeaderPatterns); err != nil {
+		return p, err
+	}
+	if p.DenyPatterns, err = compileAll(dropHeaderPatterns); err != nil {
+		return p, err
+	}
+
+	p.Rename = map[string]string{}
+	for _, r := range renameHeaders {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return p, fmt.Errorf("invalid -rename_header %q, want header=key", r)
+		}
+		p.Rename[parts[0]] = parts[1]
+	}
+
+	return p, nil
+}
+
+// logHandler builds the handler of the proxy's log messages from the flags.
+func logHandler() (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return nil, fmt.Errorf("invalid -log_level %q: %v", logLevel, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if logFormat == "json" {
+		return slog.NewJSONHandler(os.Stderr, opts), nil
+	}
+
+	return slog.NewTextHandler(os.Stderr, opts), nil
+}
+
+// deadlinePolicy builds the policy capping the deadlines of backend calls from the flags.
+func deadlinePolicy() (fb.DeadlinePolicy, error) {
+	p := fb.DeadlinePolicy{
+		Max:     maxTimeout,
+		Methods: map[string]time.Duration{},
+	}
+	for _, m := range methodMaxTimeouts {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || !strings.Contains(parts[0], "/") {
+			return p, fmt.Errorf("invalid -method_max_timeout %q, want Service/Method=duration", m)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return p, fmt.Errorf("invalid -method_max_timeout %q: %v", m, err)
+		}
+		p.Methods[strings.TrimPrefix(parts[0], "/")] = d
+	}
+
+	return p, nil
+}
+
+func compileAll(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// containsWildcard reports whether any value is made of "*" wildcards only.
+func containsWildcard(values []string) bool {
+	for _, v := range values {
+		if strings.Trim(v, "*") == "" {
+			return true
+		}
+	}
+
+	return false
 }
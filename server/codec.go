@@ -17,15 +17,23 @@ package server
 import (
 	"bytes"
 	"io"
+
+	"google.golang.org/protobuf/proto"
 )
 
 // fallbackCodec consumes data read from an io.Reader and
 // writes data into an io.Writer. This doesn't mean that the
 // data is streamed, it merely abstracts handling of the data
-// away from the RPC invocation site.
+// away from the RPC invocation site. Protobuf messages, such
+// as those built from descriptors when transcoding JSON, are
+// serialized as usual.
 type fallbackCodec struct{}
 
 func (fallbackCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+
 	buf := bytes.NewBuffer([]byte{})
 	r := v.(io.Reader)
 
@@ -34,6 +42,10 @@ func (fallbackCodec) Marshal(v interface{}) ([]byte, error) {
 }
 
 func (fallbackCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+
 	w := v.(io.Writer)
 	_, err := w.Write(data)
 	return err
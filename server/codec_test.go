@@ -20,6 +20,9 @@ import (
 	"io"
 	"reflect"
 	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func Test_fallbackCodec_Name(t *testing.T) {
@@ -120,3 +123,33 @@ func Test_fallbackCodec_Marshal(t *testing.T) {
 		})
 	}
 }
+
+func Test_fallbackCodec_protoMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *wrapperspb.StringValue
+	}{
+		{name: "basic", msg: wrapperspb.String("test")},
+		{name: "empty", msg: &wrapperspb.StringValue{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := fallbackCodec{}
+			b, err := f.Marshal(tt.msg)
+			if err != nil {
+				t.Errorf("fallbackCodec.Marshal() %s error = %v", tt.name, err)
+				return
+			}
+
+			got := &wrapperspb.StringValue{}
+			if err := f.Unmarshal(b, got); err != nil {
+				t.Errorf("fallbackCodec.Unmarshal() %s error = %v", tt.name, err)
+				return
+			}
+
+			if !proto.Equal(got, tt.msg) {
+				t.Errorf("fallbackCodec %s: got = %v, want = %v", tt.name, got, tt.msg)
+			}
+		})
+	}
+}
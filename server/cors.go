@@ -0,0 +1,199 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy configures the Cross-Origin Resource Sharing
+// headers of the server's responses.
+type CORSPolicy struct {
+	// AllowedOrigins are the origins allowed to make requests. Each is
+	// either an exact origin, like "https://example.com", or a pattern in
+	// which "*" matches any characters, like "https://*.example.com".
+	// A lone "*" allows any origin.
+	AllowedOrigins []string
+
+	// AllowedHeaders are the request headers allowed
+	// in requests, where "*" allows any header.
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers made
+	// available to scripts, beyond the safelisted ones.
+	ExposedHeaders []string
+
+	// AllowedMethods are the methods allowed in requests.
+	AllowedMethods []string
+
+	// AllowCredentials allows requests to include credentials, which
+	// requires the origins and headers to be listed explicitly, rather
+	// than allowing any with "*". The allowed origin of the request is
+	// echoed back, as browsers do not accept wildcards with credentials.
+	AllowCredentials bool
+
+	// MaxAge is how long the response to a preflight request may be cached.
+	MaxAge time.Duration
+}
+
+// DefaultCORSPolicy returns the policy used by default, which allows
+// requests without credentials from any origin, with any headers.
+func DefaultCORSPolicy() CORSPolicy {
+	return CORSPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedHeaders: []string{"*"},
+		AllowedMethods: []string{http.MethodPost},
+		MaxAge:         time.Hour,
+	}
+}
+
+// corsPolicy returns the server's CORSPolicy, defaulting to DefaultCORSPolicy.
+func (f *FallbackServer) corsPolicy() *CORSPolicy {
+	if f.cors == nil {
+		p := DefaultCORSPolicy()
+		return &p
+	}
+
+	return f.cors
+}
+
+// validate returns an error if the policy allows any origin, or any
+// headers, along with credentials, letting any site make requests on
+// behalf of its users.
+func (p *CORSPolicy) validate() error {
+	if !p.AllowCredentials {
+		return nil
+	}
+
+	for _, o := range p.AllowedOrigins {
+		if anyOrigin(o) {
+			return fmt.Errorf("origin %q not allowed with credentials, want explicit origins or patterns", o)
+		}
+	}
+	if contains(p.AllowedHeaders, "*") {
+		return errors.New("any header not allowed with credentials, want explicit headers")
+	}
+
+	return nil
+}
+
+// allowed reports whether requests from the given origin are allowed.
+// Any origin is never allowed along with credentials.
+func (p *CORSPolicy) allowed(origin string) bool {
+	for _, o := range p.AllowedOrigins {
+		if p.AllowCredentials && anyOrigin(o) {
+			continue
+		}
+		if o == "*" || matchOrigin(o, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply sets the CORS headers of the response to an allowed request.
+// It reports whether the origin of the request is allowed.
+func (p *CORSPolicy) apply(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	// only a wildcard without credentials is independent of the origin
+	wildcard := !p.AllowCredentials && contains(p.AllowedOrigins, "*")
+	if !wildcard {
+		w.Header().Add("Vary", "Origin")
+	}
+
+	switch {
+	case wildcard:
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && p.allowed(origin):
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	default:
+		return false
+	}
+
+	if p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(p.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+	}
+
+	return true
+}
+
+// preflight sets the headers of the response to a preflight request.
+func (p *CORSPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	if !p.apply(w, r) {
+		return
+	}
+
+	if len(p.AllowedHeaders) > 0 && !(p.AllowCredentials && contains(p.AllowedHeaders, "*")) {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+	}
+	if len(p.AllowedMethods) > 0 {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+	}
+	if p.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+	}
+}
+
+// matchOrigin reports whether the origin matches the pattern,
+// in which "*" matches any, possibly empty, sequence of characters.
+func matchOrigin(pattern, origin string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == origin
+	}
+
+	// the first and last parts are anchored, the rest
+	// are matched as early as possible in between
+	first, last := parts[0], parts[len(parts)-1]
+	if len(origin) < len(first)+len(last) || !strings.HasPrefix(origin, first) || !strings.HasSuffix(origin, last) {
+		return false
+	}
+
+	rest := origin[len(first) : len(origin)-len(last)]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+
+	return true
+}
+
+// anyOrigin reports whether the origin pattern matches any origin.
+func anyOrigin(pattern string) bool {
+	return strings.Trim(pattern, "*") == ""
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
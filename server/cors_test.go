@@ -0,0 +1,210 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCORSPolicy_apply(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CORSPolicy
+		origin string
+		want   http.Header
+	}{
+		{
+			name:   "any origin",
+			policy: CORSPolicy{AllowedOrigins: []string{"*"}},
+			origin: "https://example.com",
+			want:   http.Header{"Access-Control-Allow-Origin": {"*"}},
+		},
+		{
+			name:   "any origin, no origin",
+			policy: CORSPolicy{AllowedOrigins: []string{"*"}},
+			want:   http.Header{"Access-Control-Allow-Origin": {"*"}},
+		},
+		{
+			name:   "any origin with credentials",
+			policy: CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			origin: "https://example.com",
+			want:   http.Header{"Vary": {"Origin"}},
+		},
+		{
+			name:   "listed origin with credentials",
+			policy: CORSPolicy{AllowedOrigins: []string{"*", "https://example.com"}, AllowCredentials: true},
+			origin: "https://example.com",
+			want: http.Header{
+				"Access-Control-Allow-Origin":      {"https://example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Vary":                             {"Origin"},
+			},
+		},
+		{
+			name:   "listed origin",
+			policy: CORSPolicy{AllowedOrigins: []string{"https://a.com", "https://example.com"}, ExposedHeaders: []string{"X-Request-Id", "Server-Timing"}},
+			origin: "https://example.com",
+			want: http.Header{
+				"Access-Control-Allow-Origin":   {"https://example.com"},
+				"Access-Control-Expose-Headers": {"X-Request-Id, Server-Timing"},
+				"Vary":                          {"Origin"},
+			},
+		},
+		{
+			name:   "pattern origin",
+			policy: CORSPolicy{AllowedOrigins: []string{"https://*.example.com"}},
+			origin: "https://app.example.com",
+			want: http.Header{
+				"Access-Control-Allow-Origin": {"https://app.example.com"},
+				"Vary":                        {"Origin"},
+			},
+		},
+		{
+			name:   "unlisted origin",
+			policy: CORSPolicy{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true},
+			origin: "https://example.com.evil.com",
+			want:   http.Header{"Vary": {"Origin"}},
+		},
+		{
+			name:   "no origin",
+			policy: CORSPolicy{AllowedOrigins: []string{"https://a.com"}},
+			want:   http.Header{"Vary": {"Origin"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/test", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+
+			tt.policy.apply(w, r)
+
+			if got := w.Header(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CORSPolicy.apply() %s: got = %v, want = %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSPolicy_preflight(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CORSPolicy
+		origin string
+		want   http.Header
+	}{
+		{
+			name:   "default",
+			policy: DefaultCORSPolicy(),
+			origin: "https://example.com",
+			want: http.Header{
+				"Access-Control-Allow-Origin":  {"*"},
+				"Access-Control-Allow-Headers": {"*"},
+				"Access-Control-Allow-Methods": {http.MethodPost},
+				"Access-Control-Max-Age":       {"3600"},
+			},
+		},
+		{
+			name:   "credentials",
+			policy: CORSPolicy{AllowedOrigins: []string{"https://example.com"}, AllowedHeaders: []string{"X-Goog-Api-Key"}, AllowCredentials: true, MaxAge: time.Minute},
+			origin: "https://example.com",
+			want: http.Header{
+				"Access-Control-Allow-Origin":      {"https://example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Allow-Headers":     {"X-Goog-Api-Key"},
+				"Access-Control-Max-Age":           {"60"},
+				"Vary":                             {"Origin"},
+			},
+		},
+		{
+			name:   "credentials with any header",
+			policy: CORSPolicy{AllowedOrigins: []string{"https://example.com"}, AllowedHeaders: []string{"*"}, AllowCredentials: true},
+			origin: "https://example.com",
+			want: http.Header{
+				"Access-Control-Allow-Origin":      {"https://example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Vary":                             {"Origin"},
+			},
+		},
+		{
+			name:   "disallowed origin",
+			policy: CORSPolicy{AllowedOrigins: []string{"https://a.com"}, AllowedHeaders: []string{"*"}, AllowedMethods: []string{http.MethodPost}},
+			origin: "https://example.com",
+			want:   http.Header{"Vary": {"Origin"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodOptions, "/test", nil)
+			r.Header.Set("Origin", tt.origin)
+			r.Header.Set("Access-Control-Request-Headers", "x-goog-api-key")
+			w := httptest.NewRecorder()
+
+			tt.policy.preflight(w, r)
+
+			if got := w.Header(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CORSPolicy.preflight() %s: got = %v, want = %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSPolicy_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CORSPolicy
+		wantErr bool
+	}{
+		{name: "default", policy: DefaultCORSPolicy()},
+		{name: "explicit", policy: CORSPolicy{AllowedOrigins: []string{"https://*.example.com"}, AllowedHeaders: []string{"Authorization"}, AllowCredentials: true}},
+		{name: "any origin", policy: CORSPolicy{AllowedOrigins: []string{"https://example.com", "*"}, AllowCredentials: true}, wantErr: true},
+		{name: "any origin pattern", policy: CORSPolicy{AllowedOrigins: []string{"**"}, AllowCredentials: true}, wantErr: true},
+		{name: "any header", policy: CORSPolicy{AllowedOrigins: []string{"https://example.com"}, AllowedHeaders: []string{"*"}, AllowCredentials: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("CORSPolicy.validate() %s: got err = %v, want err = %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_matchOrigin(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{pattern: "https://example.com", origin: "https://example.com", want: true},
+		{pattern: "https://example.com", origin: "http://example.com"},
+		{pattern: "https://*.example.com", origin: "https://a.example.com", want: true},
+		{pattern: "https://*.example.com", origin: "https://a.b.example.com", want: true},
+		{pattern: "https://*.example.com", origin: "https://example.com"},
+		{pattern: "http://localhost:*", origin: "http://localhost:8080", want: true},
+		{pattern: "http://localhost:*", origin: "https://localhost:8080"},
+		{pattern: "https://*.dev.*.com", origin: "https://a.dev.b.com", want: true},
+		{pattern: "https://*.dev.*.com", origin: "https://a.prod.b.com"},
+	}
+	for _, tt := range tests {
+		if got := matchOrigin(tt.pattern, tt.origin); got != tt.want {
+			t.Errorf("matchOrigin(%q, %q): got = %v, want = %v", tt.pattern, tt.origin, got, tt.want)
+		}
+	}
+}
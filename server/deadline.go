@@ -0,0 +1,163 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DeadlinePolicy caps the deadlines of backend calls. Requests set their
+// own deadline with the X-Server-Timeout header, in seconds, as sent by
+// Google's fallback clients, or the grpc-timeout header of gRPC-Web.
+type DeadlinePolicy struct {
+	// Max is the longest timeout of any call, which is also
+	// used for requests without one. Zero means no limit.
+	Max time.Duration
+
+	// Methods overrides Max for the methods it maps,
+	// named like "google.example.v1.Service/Method".
+	Methods map[string]time.Duration
+}
+
+// grpcTimeoutUnits maps the units of grpc-timeout values to their durations.
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// requestContext returns the context of backend calls made for the request
+// to the given method, in the form built by buildMethod. It is canceled when
+// the client goes away, has the request's deadline, if any, capped by the
+// server's DeadlinePolicy, and carries the request headers as metadata.
+// The method is also recorded for the metrics of the request, and the context
+// carries the trace context of its span, if it is traced.
+func (f *FallbackServer) requestContext(r *http.Request, method string) (context.Context, context.CancelFunc, error) {
+	f.recordMethod(r, method)
+	parent := startSpan(r, method)
+
+	timeout, ok, err := requestTimeout(r.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if f.deadlines != nil {
+		if max := f.deadlines.limit(strings.TrimPrefix(method, "/")); max > 0 && (!ok || timeout > max) {
+			timeout, ok = max, true
+		}
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if ok {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+
+	return injectSpan(f.prepareHeaders(ctx, r.Header), r), cancel, nil
+}
+
+// limit returns the maximum timeout of the given method, or zero if unlimited.
+func (p *DeadlinePolicy) limit(method string) time.Duration {
+	if d, ok := p.Methods[method]; ok {
+		return d
+	}
+
+	return p.Max
+}
+
+// requestTimeout returns the shorter of the timeouts set by the
+// X-Server-Timeout and grpc-timeout headers, and whether either is set.
+func requestTimeout(hdr http.Header) (time.Duration, bool, error) {
+	var timeout time.Duration
+	var ok bool
+
+	if v := hdr.Get("X-Server-Timeout"); v != "" {
+		d, err := parseServerTimeout(v)
+		if err != nil {
+			return 0, false, status.Errorf(codes.InvalidArgument, "invalid X-Server-Timeout %q: %v", v, err)
+		}
+		timeout, ok = d, true
+	}
+
+	if v := hdr.Get("Grpc-Timeout"); v != "" {
+		d, err := parseGRPCTimeout(v)
+		if err != nil {
+			return 0, false, status.Errorf(codes.InvalidArgument, "invalid grpc-timeout %q: %v", v, err)
+		}
+		if !ok || d < timeout {
+			timeout, ok = d, true
+		}
+	}
+
+	return timeout, ok, nil
+}
+
+// parseServerTimeout parses an X-Server-Timeout value, which is
+// a non-negative, possibly fractional, number of seconds.
+func parseServerTimeout(v string) (time.Duration, error) {
+	s, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if s < 0 || math.IsNaN(s) {
+		return 0, fmt.Errorf("must be a non-negative number of seconds")
+	}
+
+	if s >= float64(math.MaxInt64)/float64(time.Second) {
+		return math.MaxInt64, nil
+	}
+
+	return time.Duration(s * float64(time.Second)), nil
+}
+
+// parseGRPCTimeout parses a grpc-timeout value, which is
+// at most 8 digits followed by a unit.
+// See: https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+func parseGRPCTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("must be 1 to 8 digits followed by a unit")
+	}
+
+	unit, ok := grpcTimeoutUnits[v[len(v)-1]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", v[len(v)-1:])
+	}
+
+	digits := v[:len(v)-1]
+	if strings.Trim(digits, "0123456789") != "" {
+		return 0, fmt.Errorf("must be 1 to 8 digits followed by a unit")
+	}
+
+	n, _ := strconv.ParseInt(digits, 10, 64)
+	if n > int64(math.MaxInt64/unit) {
+		return math.MaxInt64, nil
+	}
+
+	return time.Duration(n) * unit, nil
+}
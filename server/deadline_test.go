@@ -0,0 +1,235 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+func Test_requestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		hdr     http.Header
+		want    time.Duration
+		wantOK  bool
+		wantErr bool
+	}{
+		{name: "none", hdr: http.Header{}},
+		{name: "server timeout", hdr: http.Header{"X-Server-Timeout": {"30"}}, want: 30 * time.Second, wantOK: true},
+		{name: "fractional server timeout", hdr: http.Header{"X-Server-Timeout": {"0.25"}}, want: 250 * time.Millisecond, wantOK: true},
+		{name: "zero server timeout", hdr: http.Header{"X-Server-Timeout": {"0"}}, wantOK: true},
+		{name: "huge server timeout", hdr: http.Header{"X-Server-Timeout": {"1e300"}}, want: math.MaxInt64, wantOK: true},
+		{name: "negative server timeout", hdr: http.Header{"X-Server-Timeout": {"-1"}}, wantErr: true},
+		{name: "invalid server timeout", hdr: http.Header{"X-Server-Timeout": {"soon"}}, wantErr: true},
+		{name: "grpc-timeout", hdr: http.Header{"Grpc-Timeout": {"100m"}}, want: 100 * time.Millisecond, wantOK: true},
+		{name: "grpc-timeout hours", hdr: http.Header{"Grpc-Timeout": {"2H"}}, want: 2 * time.Hour, wantOK: true},
+		{name: "huge grpc-timeout", hdr: http.Header{"Grpc-Timeout": {"99999999H"}}, want: math.MaxInt64, wantOK: true},
+		{name: "grpc-timeout without unit", hdr: http.Header{"Grpc-Timeout": {"100"}}, wantErr: true},
+		{name: "grpc-timeout too long", hdr: http.Header{"Grpc-Timeout": {"123456789S"}}, wantErr: true},
+		{name: "grpc-timeout with sign", hdr: http.Header{"Grpc-Timeout": {"-1S"}}, wantErr: true},
+		{name: "grpc-timeout without digits", hdr: http.Header{"Grpc-Timeout": {"S"}}, wantErr: true},
+		{name: "shorter of both", hdr: http.Header{"X-Server-Timeout": {"30"}, "Grpc-Timeout": {"10S"}}, want: 10 * time.Second, wantOK: true},
+		{name: "shorter of both, server timeout", hdr: http.Header{"X-Server-Timeout": {"5"}, "Grpc-Timeout": {"10S"}}, want: 5 * time.Second, wantOK: true},
+	}
+	for _, tt := range tests {
+		got, ok, err := requestTimeout(tt.hdr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("requestTimeout() %s: got err = %v, want err = %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("requestTimeout() %s: got code = %v, want = %v", tt.name, status.Code(err), codes.InvalidArgument)
+			}
+			continue
+		}
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("requestTimeout() %s: got = %v, %v, want = %v, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestFallbackServer_requestContext(t *testing.T) {
+	policy := &DeadlinePolicy{
+		Max:     time.Minute,
+		Methods: map[string]time.Duration{"grpc.health.v1.Health/Watch": time.Hour},
+	}
+
+	tests := []struct {
+		name      string
+		policy    *DeadlinePolicy
+		method    string
+		timeout   string
+		want      time.Duration
+		wantNoDdl bool
+	}{
+		{name: "no deadline", method: "/grpc.health.v1.Health/Check", wantNoDdl: true},
+		{name: "request deadline", method: "/grpc.health.v1.Health/Check", timeout: "10", want: 10 * time.Second},
+		{name: "max", policy: policy, method: "/grpc.health.v1.Health/Check", want: time.Minute},
+		{name: "capped by max", policy: policy, method: "/grpc.health.v1.Health/Check", timeout: "3600", want: time.Minute},
+		{name: "under max", policy: policy, method: "/grpc.health.v1.Health/Check", timeout: "10", want: 10 * time.Second},
+		{name: "method max", policy: policy, method: "/grpc.health.v1.Health/Watch", timeout: "7200", want: time.Hour},
+		{name: "unlimited method", policy: &DeadlinePolicy{Max: time.Minute, Methods: map[string]time.Duration{"grpc.health.v1.Health/Watch": 0}}, method: "/grpc.health.v1.Health/Watch", wantNoDdl: true},
+	}
+	for _, tt := range tests {
+		f := &FallbackServer{deadlines: tt.policy}
+		r := httptest.NewRequest(http.MethodPost, "/test", nil)
+		if tt.timeout != "" {
+			r.Header.Set("X-Server-Timeout", tt.timeout)
+		}
+
+		ctx, cancel, err := f.requestContext(r, tt.method)
+		if err != nil {
+			t.Errorf("requestContext() %s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		defer cancel()
+
+		ddl, ok := ctx.Deadline()
+		if ok == tt.wantNoDdl {
+			t.Errorf("requestContext() %s: got deadline = %v, want = %v", tt.name, ok, !tt.wantNoDdl)
+			continue
+		}
+		if got := time.Until(ddl); ok && (got > tt.want || got < tt.want-time.Second) {
+			t.Errorf("requestContext() %s: got timeout = %v, want = %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the context is canceled along with the request
+	parent, cancelParent := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/test", nil).WithContext(parent)
+	ctx, cancel, _ := (&FallbackServer{}).requestContext(r, "/grpc.health.v1.Health/Check")
+	defer cancel()
+
+	cancelParent()
+	if ctx.Err() != context.Canceled {
+		t.Errorf("requestContext() canceled request: got = %v, want = %v", ctx.Err(), context.Canceled)
+	}
+}
+
+func TestFallbackServer_deadlineExceeded(t *testing.T) {
+	cc := testBackend(t, false)
+
+	tests := []struct {
+		name        string
+		policy      *DeadlinePolicy
+		contentType string
+		hdr         http.Header
+		wantStatus  int
+		wantCode    codes.Code
+	}{
+		{
+			name:       "server timeout",
+			hdr:        http.Header{"X-Server-Timeout": {"0.05"}},
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   codes.DeadlineExceeded,
+		},
+		{
+			name:       "grpc-timeout",
+			hdr:        http.Header{"Grpc-Timeout": {"50m"}},
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   codes.DeadlineExceeded,
+		},
+		{
+			name:       "expired",
+			hdr:        http.Header{"X-Server-Timeout": {"0"}},
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   codes.DeadlineExceeded,
+		},
+		{
+			name:       "max",
+			policy:     &DeadlinePolicy{Max: 50 * time.Millisecond},
+			hdr:        http.Header{"X-Server-Timeout": {"60"}},
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   codes.DeadlineExceeded,
+		},
+		{
+			name:        "JSON",
+			contentType: jsonType,
+			hdr:         http.Header{"X-Server-Timeout": {"0.05"}},
+			wantStatus:  http.StatusGatewayTimeout,
+			wantCode:    codes.DeadlineExceeded,
+		},
+		{
+			name:       "invalid timeout",
+			hdr:        http.Header{"X-Server-Timeout": {"soon"}},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: cc, deadlines: tt.policy}
+
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.handler).Headers("Content-Type", protoType)
+			r.HandleFunc(fallbackPath, f.jsonHandler).Headers("Content-Type", jsonType)
+			s := httptest.NewServer(r)
+			defer s.Close()
+
+			ct := protoType
+			body, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "slow"})
+			if tt.contentType == jsonType {
+				ct = jsonType
+				body = []byte(`{"service": "slow"}`)
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, s.URL+"/$rpc/grpc.health.v1.Health/Check", bytes.NewReader(body))
+			req.Header = tt.hdr
+			req.Header.Set("Content-Type", ct)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("deadlineExceeded() %s: %v", tt.name, err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("deadlineExceeded() %s: got status = %d, want = %d", tt.name, res.StatusCode, tt.wantStatus)
+			}
+
+			b, _ := ioutil.ReadAll(res.Body)
+			st := &statuspb.Status{}
+			if tt.contentType == jsonType {
+				err = protojson.Unmarshal(b, st)
+			} else {
+				err = proto.Unmarshal(b, st)
+			}
+			if err != nil {
+				t.Fatalf("deadlineExceeded() %s: invalid status body %q: %v", tt.name, b, err)
+			}
+			if got := codes.Code(st.GetCode()); got != tt.wantCode {
+				t.Errorf("deadlineExceeded() %s: got code = %v, want = %v", tt.name, got, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// DescriptorSource resolves the protobuf descriptors of the
+// services proxied by a FallbackServer.
+type DescriptorSource interface {
+	// FindService returns the descriptor of the service with the given
+	// fully-qualified name. An error with a NotFound status is returned
+	// if the service is known not to exist. Any other error means the
+	// service could not be resolved.
+	FindService(name string) (protoreflect.ServiceDescriptor, error)
+}
+
+// refresher is implemented by a DescriptorSource that caches
+// descriptors and can be told to drop them.
+type refresher interface {
+	Refresh()
+}
+
+// serviceLister is implemented by a DescriptorSource that
+// can enumerate all of the services it knows about.
+type serviceLister interface {
+	Services() ([]protoreflect.ServiceDescriptor, error)
+}
+
+// globalSource is a DescriptorSource for the descriptors
+// linked into the binary.
+type globalSource struct{}
+
+func (globalSource) FindService(name string) (protoreflect.ServiceDescriptor, error) {
+	return findService(protoregistry.GlobalFiles, name)
+}
+
+func (globalSource) Services() ([]protoreflect.ServiceDescriptor, error) {
+	return listServices(protoregistry.GlobalFiles), nil
+}
+
+// multiSource is a DescriptorSource that tries each of its sources
+// in order. A NotFound status is only returned if every source
+// reports the service as unknown.
+type multiSource []DescriptorSource
+
+func (m multiSource) FindService(name string) (protoreflect.ServiceDescriptor, error) {
+	err := status.Errorf(codes.NotFound, "unknown service %s", name)
+	for _, src := range m {
+		sd, sErr := src.FindService(name)
+		if sErr == nil {
+			return sd, nil
+		}
+
+		// prefer reporting a failed lookup over NotFound
+		if status.Code(err) == codes.NotFound {
+			err = sErr
+		}
+	}
+
+	return nil, err
+}
+
+// Services lists the services of every source that can enumerate them,
+// preferring earlier sources for services they have in common. Sources
+// that fail are skipped, and the first error is returned along with the
+// services that could be listed.
+func (m multiSource) Services() ([]protoreflect.ServiceDescriptor, error) {
+	var services []protoreflect.ServiceDescriptor
+	var err error
+	seen := make(map[protoreflect.FullName]bool)
+	for _, src := range m {
+		l, ok := src.(serviceLister)
+		if !ok {
+			continue
+		}
+
+		sds, lErr := l.Services()
+		if lErr != nil && err == nil {
+			err = lErr
+		}
+		for _, sd := range sds {
+			if !seen[sd.FullName()] {
+				seen[sd.FullName()] = true
+				services = append(services, sd)
+			}
+		}
+	}
+
+	return services, err
+}
+
+func (m multiSource) Refresh() {
+	for _, src := range m {
+		if r, ok := src.(refresher); ok {
+			r.Refresh()
+		}
+	}
+}
+
+// findService looks up the named service descriptor in the given registry.
+func findService(files *protoregistry.Files, name string) (protoreflect.ServiceDescriptor, error) {
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "unknown service %s", name)
+	}
+
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s is not a service", name)
+	}
+
+	return sd, nil
+}
+
+// listServices lists the service descriptors in the given registry.
+func listServices(files *protoregistry.Files) []protoreflect.ServiceDescriptor {
+	var services []protoreflect.ServiceDescriptor
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			services = append(services, fd.Services().Get(i))
+		}
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].FullName() < services[j].FullName()
+	})
+
+	return services
+}
+
+// findMethod resolves the descriptor of the given RPC. The configured
+// DescriptorSource is used, if any, otherwise the protobuf descriptors
+// linked into the binary are used. A NotFound status is returned if
+// either the service or the method is unknown.
+func (f *FallbackServer) findMethod(service, method string) (protoreflect.MethodDescriptor, error) {
+	var src DescriptorSource = globalSource{}
+	if f.descriptors != nil {
+		src = f.descriptors
+	}
+
+	sd, err := src.FindService(service)
+	if err != nil {
+		return nil, err
+	}
+
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, status.Errorf(codes.NotFound, "unknown method %s for service %s", method, service)
+	}
+
+	return md, nil
+}
+
+// RefreshDescriptors drops any descriptors cached by the server,
+// such as those retrieved via server reflection, so that they are
+// resolved again on their next use.
+func (f *FallbackServer) RefreshDescriptors() {
+	if r, ok := f.descriptors.(refresher); ok {
+		r.Refresh()
+	}
+	for _, vh := range f.vhosts {
+		if vh.server != nil {
+			vh.server.RefreshDescriptors()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	_ "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testSource is a DescriptorSource that fails every lookup with err,
+// if set, and otherwise serves the descriptors linked into the binary.
+type testSource struct {
+	err       error
+	refreshed bool
+}
+
+func (s *testSource) FindService(name string) (protoreflect.ServiceDescriptor, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return globalSource{}.FindService(name)
+}
+
+func (s *testSource) Refresh() {
+	s.refreshed = true
+}
+
+func TestFallbackServer_findMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      DescriptorSource
+		service  string
+		method   string
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "basic", service: "grpc.health.v1.Health", method: "Check", want: "grpc.health.v1.Health.Check"},
+		{name: "unknown service", service: "foo.Bar", method: "Check", wantCode: codes.NotFound},
+		{name: "not a service", service: "grpc.health.v1.HealthCheckRequest", method: "Check", wantCode: codes.NotFound},
+		{name: "unknown method", service: "grpc.health.v1.Health", method: "Nope", wantCode: codes.NotFound},
+		{name: "configured source", src: &testSource{}, service: "grpc.health.v1.Health", method: "Watch", want: "grpc.health.v1.Health.Watch"},
+		{name: "source error", src: &testSource{err: status.Error(codes.Unavailable, "test")}, service: "grpc.health.v1.Health", method: "Check", wantCode: codes.Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{descriptors: tt.src}
+			got, err := f.findMethod(tt.service, tt.method)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("findMethod() %s code: got = %v, want = %v", tt.name, code, tt.wantCode)
+				return
+			}
+
+			if err == nil && string(got.FullName()) != tt.want {
+				t.Errorf("findMethod() %s: got = %v, want = %v", tt.name, got.FullName(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_RefreshDescriptors(t *testing.T) {
+	src := &testSource{}
+	f := &FallbackServer{descriptors: src}
+	f.RefreshDescriptors()
+
+	if !src.refreshed {
+		t.Errorf("RefreshDescriptors() did not refresh the DescriptorSource")
+	}
+
+	// must be safe to call without a source
+	(&FallbackServer{}).RefreshDescriptors()
+}
+
+func TestFallbackServer_handler_unknownMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      DescriptorSource
+		path     string
+		wantCode int
+		wantCall bool
+	}{
+		{name: "known method", src: &testSource{}, path: "/$rpc/grpc.health.v1.Health/Check", wantCode: http.StatusOK, wantCall: true},
+		{name: "unknown method", src: &testSource{}, path: "/$rpc/grpc.health.v1.Health/Nope", wantCode: http.StatusNotFound},
+		{name: "unknown service", src: &testSource{}, path: "/$rpc/foo.Bar/Check", wantCode: http.StatusNotFound},
+		{name: "source unavailable", src: &testSource{err: status.Error(codes.Unimplemented, "test")}, path: "/$rpc/foo.Bar/Check", wantCode: http.StatusOK, wantCall: true},
+		{name: "no source", path: "/$rpc/foo.Bar/Check", wantCode: http.StatusOK, wantCall: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := &testConnection{res: []byte{}}
+			f := &FallbackServer{cc: cc, descriptors: tt.src}
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.handler)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, http.NoBody)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.wantCode {
+				t.Errorf("handler() %s code: got = %d, want = %d", tt.name, resp.Code, tt.wantCode)
+			}
+
+			if called := cc.req != nil; called != tt.wantCall {
+				t.Errorf("handler() %s backend called: got = %v, want = %v", tt.name, called, tt.wantCall)
+			}
+		})
+	}
+}
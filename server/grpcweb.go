@@ -0,0 +1,254 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// grpcWebPath is the standard gRPC path used by grpc-web clients.
+	grpcWebPath = "/{service:[.a-zA-Z0-9]+}/{method:[a-zA-Z]+}"
+
+	grpcWebType     = "application/grpc-web"
+	grpcWebTextType = "application/grpc-web-text"
+
+	// grpcWebTypes matches the content types of grpc-web requests
+	// using the protobuf binary format, optionally base64 encoded.
+	grpcWebTypes = `^application/grpc-web(-text)?(\+proto)?\s*(;|$)`
+
+	// compressedFrame flags a frame whose payload is compressed.
+	compressedFrame byte = 0x01
+)
+
+// isGRPCWebPreflight matches the CORS preflights of grpc-web requests,
+// which ask for the x-grpc-web header, so that the preflights of other
+// requests on paths of the same shape are not allowed on their behalf.
+func isGRPCWebPreflight(r *http.Request, _ *mux.RouteMatch) bool {
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, h := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(h), "x-grpc-web") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// grpcWebHandler is an HTTP handler for grpc-web requests. The request body
+// is made up of length-prefixed message frames, and the response body of the
+// response message frames followed by a frame carrying the trailers, which
+// include the status of the RPC. In grpc-web-text requests and responses,
+// the frames are base64 encoded.
+func (f *FallbackServer) grpcWebHandler(w http.ResponseWriter, r *http.Request) {
+	logger(r).Debug("Incoming grpc-web request", "uri", r.RequestURI)
+	v := mux.Vars(r)
+
+	// allow the origins permitted by the CORS policy
+	f.corsPolicy().apply(w, r)
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	fr := &grpcWebFramer{
+		ct:   ct,
+		text: strings.HasPrefix(ct, grpcWebTextType),
+	}
+
+	// fail fast on methods the backend is known not to serve
+	if _, err := f.findMethod(v["service"], v["method"]); f.descriptors != nil && status.Code(err) == codes.NotFound {
+		fr.fail(w, r, err)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if fr.text {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	// copy headers into out-going context metadata
+	m := buildMethod(v["service"], v["method"])
+	ctx, cancel, err := f.requestContext(r, m)
+	if err != nil {
+		fr.fail(w, r, err)
+		return
+	}
+	defer cancel()
+
+	// the stream is opened as bidirectional, because the requests and
+	// responses of any kind of method are framed in the same way
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	stream, err := f.cc.NewStream(ctx, desc, m)
+	if err != nil {
+		fr.fail(w, r, err)
+		return
+	}
+
+	if err := sendRequests(stream, &frameReader{r: body}); err != nil {
+		fr.fail(w, r, err)
+		return
+	}
+
+	f.relayResponses(w, r, stream, fr)
+}
+
+// frameReader reads the length-prefixed message frames of a grpc-web request.
+type frameReader struct {
+	r io.Reader
+}
+
+func (fr *frameReader) next() ([]byte, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(fr.r, hdr); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "error reading request frame: %v", err)
+	}
+
+	switch {
+	case hdr[0]&compressedFrame != 0:
+		return nil, status.Error(codes.Unimplemented, "compressed request messages are not supported")
+	case hdr[0] != messageFrame:
+		return nil, status.Errorf(codes.InvalidArgument, "unexpected request frame flag %#x", hdr[0])
+	}
+
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxRequestMessageSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "request message of %d bytes exceeds the limit of %d bytes", n, maxRequestMessageSize)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(fr.r, b); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "error reading request message: %v", err)
+	}
+
+	return b, nil
+}
+
+// grpcWebFramer writes the frames of a grpc-web response.
+type grpcWebFramer struct {
+	// ct is the content type of the request, which is
+	// also that of the response
+	ct string
+
+	// whether frames are base64 encoded
+	text bool
+
+	// trailer metadata written in the trailers frame
+	trailer http.Header
+}
+
+func (g *grpcWebFramer) contentType() string {
+	return g.ct
+}
+
+func (g *grpcWebFramer) message(w io.Writer, b []byte) error {
+	return g.frame(w, messageFrame, b)
+}
+
+func (g *grpcWebFramer) setTrailer(trailer http.Header) {
+	g.trailer = trailer
+}
+
+// end writes the trailers frame, made up of the status and the trailer
+// metadata formatted like HTTP/1 headers, with lowercase names.
+func (g *grpcWebFramer) end(w io.Writer, st *status.Status) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "grpc-status: %d\r\n", st.Code())
+	if st.Message() != "" {
+		fmt.Fprintf(&sb, "grpc-message: %s\r\n", encodeGRPCMessage(st.Message()))
+	}
+	if len(st.Proto().GetDetails()) > 0 {
+		if b, err := proto.Marshal(st.Proto()); err == nil {
+			fmt.Fprintf(&sb, "grpc-status-details-bin: %s\r\n", base64.RawStdEncoding.EncodeToString(b))
+		}
+	}
+
+	keys := make([]string, 0, len(g.trailer))
+	for k := range g.trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range g.trailer[k] {
+			fmt.Fprintf(&sb, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+
+	return g.frame(w, statusFrame, []byte(sb.String()))
+}
+
+// fail writes the error in the trailers frame of an otherwise successful
+// response, because that is where grpc-web clients expect the status to be.
+func (g *grpcWebFramer) fail(w http.ResponseWriter, r *http.Request, err error) {
+	logger(r).Debug("Error handling request", "uri", r.RequestURI, "error", err)
+	recordCode(r, status.Code(err))
+
+	w.Header().Set("Content-Type", g.ct)
+	w.WriteHeader(http.StatusOK)
+	g.end(w, status.Convert(err))
+}
+
+func (g *grpcWebFramer) single(w http.ResponseWriter, b []byte) error {
+	w.Header().Set("Content-Type", g.ct)
+	if err := g.message(w, b); err != nil {
+		return err
+	}
+
+	return g.end(w, status.New(codes.OK, ""))
+}
+
+// frame writes a single frame, base64 encoding it in grpc-web-text responses.
+func (g *grpcWebFramer) frame(w io.Writer, flag byte, b []byte) error {
+	if !g.text {
+		return writeFrame(w, flag, b)
+	}
+
+	var buf bytes.Buffer
+	writeFrame(&buf, flag, b)
+	_, err := io.WriteString(w, base64.StdEncoding.EncodeToString(buf.Bytes()))
+	return err
+}
+
+// encodeGRPCMessage percent-encodes a status message for the grpc-message
+// trailer, as required by the gRPC protocol for characters outside of the
+// printable ASCII range, and for the percent sign itself.
+func encodeGRPCMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,226 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcWebBody frames the given request message, with the given flag.
+func grpcWebBody(flag byte, msg proto.Message) []byte {
+	b, _ := proto.Marshal(msg)
+	var buf bytes.Buffer
+	writeFrame(&buf, flag, b)
+	return buf.Bytes()
+}
+
+// decodeChunks decodes a grpc-web-text body, which may be made up of
+// several padded base64 chunks, by decoding each group of four characters.
+func decodeChunks(t *testing.T, s string) []byte {
+	var out []byte
+	for i := 0; i+4 <= len(s); i += 4 {
+		b, err := base64.StdEncoding.DecodeString(s[i : i+4])
+		if err != nil {
+			t.Fatalf("error decoding grpc-web-text body: %v", err)
+		}
+		out = append(out, b...)
+	}
+
+	return out
+}
+
+func TestFallbackServer_grpcWebHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		contentType  string
+		body         []byte
+		sources      []DescriptorSource
+		policy       *ResponseMetadataPolicy
+		wantStatuses []healthpb.HealthCheckResponse_ServingStatus
+		wantTrailers string
+	}{
+		{
+			name:         "unary",
+			method:       "Check",
+			contentType:  "application/grpc-web+proto",
+			body:         grpcWebBody(messageFrame, &healthpb.HealthCheckRequest{}),
+			wantStatuses: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING},
+			wantTrailers: "grpc-status: 0\r\n",
+		},
+		{
+			name:         "server streaming",
+			method:       "Watch",
+			contentType:  "application/grpc-web",
+			body:         grpcWebBody(messageFrame, &healthpb.HealthCheckRequest{}),
+			wantStatuses: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING},
+			wantTrailers: "grpc-status: 0\r\n",
+		},
+		{
+			name:         "text",
+			method:       "Watch",
+			contentType:  "application/grpc-web-text",
+			body:         []byte(base64.StdEncoding.EncodeToString(grpcWebBody(messageFrame, &healthpb.HealthCheckRequest{Service: "fail"}))),
+			wantStatuses: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING},
+			wantTrailers: "grpc-status: 13\r\ngrpc-message: failed\r\n",
+		},
+		{
+			name:         "trailer metadata",
+			method:       "Check",
+			contentType:  "application/grpc-web+proto",
+			body:         grpcWebBody(messageFrame, &healthpb.HealthCheckRequest{Service: "metadata"}),
+			wantStatuses: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING},
+			wantTrailers: "grpc-status: 0\r\nx-test-trailer: done\r\n",
+		},
+		{
+			name:         "streamed trailer metadata",
+			method:       "Watch",
+			contentType:  "application/grpc-web-text",
+			body:         []byte(base64.StdEncoding.EncodeToString(grpcWebBody(messageFrame, &healthpb.HealthCheckRequest{Service: "metadata"}))),
+			policy:       &ResponseMetadataPolicy{Filter: DefaultResponseMetadataPolicy().Filter, TrailerPrefix: "Grpc-Trailer-"},
+			wantStatuses: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING},
+			wantTrailers: "grpc-status: 0\r\ngrpc-trailer-x-test-trailer: done\r\n",
+		},
+		{
+			name:         "backend error",
+			method:       "Check",
+			contentType:  "application/grpc-web+proto",
+			body:         grpcWebBody(messageFrame, &healthpb.HealthCheckRequest{Service: "error"}),
+			wantTrailers: "grpc-status: 5\r\ngrpc-message: unknown service\r\n",
+		},
+		{
+			name:         "compressed request",
+			method:       "Check",
+			contentType:  "application/grpc-web+proto",
+			body:         grpcWebBody(compressedFrame, &healthpb.HealthCheckRequest{}),
+			wantTrailers: "grpc-status: 12\r\ngrpc-message: compressed request messages are not supported\r\n",
+		},
+		{
+			name:         "unknown method",
+			method:       "Check",
+			contentType:  "application/grpc-web+proto",
+			body:         grpcWebBody(messageFrame, &healthpb.HealthCheckRequest{}),
+			sources:      []DescriptorSource{&testSource{err: status.Error(codes.NotFound, "unknown")}},
+			wantTrailers: "grpc-status: 5\r\ngrpc-message: unknown\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: testBackend(t, false), respMetadata: tt.policy}
+			if len(tt.sources) > 0 {
+				f.descriptors = multiSource(tt.sources)
+			}
+			r := mux.NewRouter()
+			r.HandleFunc(grpcWebPath, f.grpcWebHandler).
+				HeadersRegexp("Content-Type", grpcWebTypes)
+
+			req := httptest.NewRequest(http.MethodPost, "/grpc.health.v1.Health/"+tt.method, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != http.StatusOK {
+				t.Fatalf("grpcWebHandler() %s code: got = %d, want = %d", tt.name, resp.Code, http.StatusOK)
+			}
+			if ct := resp.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("grpcWebHandler() %s content-type: got = %s, want = %s", tt.name, ct, tt.contentType)
+			}
+
+			body := resp.Body.Bytes()
+			if strings.HasPrefix(tt.contentType, grpcWebTextType) {
+				body = decodeChunks(t, resp.Body.String())
+			}
+
+			frames := readFrames(t, body)
+			if len(frames) != len(tt.wantStatuses)+1 {
+				t.Fatalf("grpcWebHandler() %s: got = %d frames, want = %d", tt.name, len(frames), len(tt.wantStatuses)+1)
+			}
+
+			for i, want := range tt.wantStatuses {
+				res := &healthpb.HealthCheckResponse{}
+				if frames[i].flag != messageFrame || proto.Unmarshal(frames[i].data, res) != nil || res.GetStatus() != want {
+					t.Errorf("grpcWebHandler() %s frame %d: got = %v, want = %v", tt.name, i, frames[i], want)
+				}
+			}
+
+			last := frames[len(frames)-1]
+			if last.flag != statusFrame || string(last.data) != tt.wantTrailers {
+				t.Errorf("grpcWebHandler() %s trailers: got = %q, want = %q", tt.name, last.data, tt.wantTrailers)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_grpcWebPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		want    string
+	}{
+		{name: "grpc-web", headers: "content-type,x-grpc-web,x-user-agent", want: "POST"},
+		{name: "mixed case", headers: "Content-Type, X-Grpc-Web", want: "POST"},
+		{name: "other request", headers: "content-type"},
+		{name: "no headers"},
+	}
+	for _, tt := range tests {
+		h, err := NewHandler(&testConnection{})
+		if err != nil {
+			t.Fatalf("NewHandler() %s: %v", tt.name, err)
+		}
+
+		req := httptest.NewRequest(http.MethodOptions, "/a.B/C", nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		if tt.headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", tt.headers)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+
+		if got := resp.Header().Get("Access-Control-Allow-Methods"); got != tt.want {
+			t.Errorf("grpcWebPreflight() %s: got = %d %q, want = %q", tt.name, resp.Code, got, tt.want)
+		}
+	}
+}
+
+func Test_encodeGRPCMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{name: "printable", msg: "not found: a/b", want: "not found: a/b"},
+		{name: "percent", msg: "100%", want: "100%25"},
+		{name: "newline", msg: "a\nb", want: "a%0Ab"},
+		{name: "unicode", msg: "café", want: "caf%C3%A9"},
+	}
+	for _, tt := range tests {
+		if got := encodeGRPCMessage(tt.msg); got != tt.want {
+			t.Errorf("encodeGRPCMessage() %s: got = %s, want = %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// Handler is an http.Handler serving the grpc-fallback endpoints, to mount
+// in an existing HTTP server, along with its own handlers and middleware.
+type Handler struct {
+	http.Handler
+
+	f *FallbackServer
+}
+
+// NewHandler returns a Handler proxying to the gRPC backend of the given
+// connection. The handler is customized with the given options, if any,
+// like the server of NewServer, and the connection remains owned by the
+// caller.
+//
+// Options that configure the HTTP server itself, such as WithTLS, WithH2C,
+// WithHTTPServer and WithListener, have no effect. The metrics path of
+// WithMetrics is served by the handler, whatever the address given.
+func NewHandler(cc grpc.ClientConnInterface, opts ...Option) (*Handler, error) {
+	return newHandler(&FallbackServer{conn: cc}, opts)
+}
+
+// NewTargetHandler returns a Handler like NewHandler, which proxies to the
+// gRPC backend at the given target, dialed like the backend of NewServer.
+func NewTargetHandler(target string, opts ...Option) (*Handler, error) {
+	return newHandler(&FallbackServer{backend: target}, opts)
+}
+
+func newHandler(f *FallbackServer, opts []Option) (*Handler, error) {
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	r, err := f.router()
+	if err != nil {
+		f.closeBackends()
+		return nil, err
+	}
+
+	return &Handler{Handler: r, f: f}, nil
+}
+
+// Close closes the connections the handler dialed, such as those to
+// the target of NewTargetHandler and the backends of WithRoutes, but
+// not the connection given to NewHandler.
+func (h *Handler) Close() error {
+	return h.f.closeBackends()
+}
+
+// codecConnection is a connection supplied by the caller, whose calls
+// are made with the codec of the server, whatever its defaults.
+type codecConnection struct {
+	cc grpc.ClientConnInterface
+}
+
+func (c codecConnection) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	return c.cc.Invoke(ctx, method, args, reply, append(opts, grpc.ForceCodec(fallbackCodec{}))...)
+}
+
+func (c codecConnection) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return c.cc.NewStream(ctx, desc, method, append(opts, grpc.ForceCodec(fallbackCodec{}))...)
+}
+
+// unwrapConnection returns the connection supplied by the caller,
+// so that its state may be reported, or the given connection.
+func unwrapConnection(cc connection) connection {
+	if c, ok := cc.(codecConnection); ok {
+		return c.cc
+	}
+
+	return cc
+}
+
+// cleanPathPrefix returns the path prefix with a leading slash and
+// no trailing slash, or empty for the root.
+func cleanPathPrefix(prefix string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	return prefix
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestNewHandler(t *testing.T) {
+	// the caller's connection has no codec of its own
+	cc, err := grpc.Dial("bufnet", lifecycleBackend(t)...)
+	if err != nil {
+		t.Fatalf("error dialing test backend: %v", err)
+	}
+	defer cc.Close()
+
+	h, err := NewHandler(cc, WithPathPrefix("fallback/"), WithMetrics("", ":9090"))
+	if err != nil {
+		t.Fatalf("NewHandler(): got err = %v, want = nil", err)
+	}
+	target, err := NewTargetHandler("bufnet", WithDialOptions(lifecycleBackend(t)...), WithPathPrefix("/fallback"), WithMetrics("", ""))
+	if err != nil {
+		t.Fatalf("NewTargetHandler(): got err = %v, want = nil", err)
+	}
+
+	for name, h := range map[string]*Handler{"NewHandler()": h, "NewTargetHandler()": target} {
+		// mounted alongside the other handlers of the caller
+		mux := http.NewServeMux()
+		mux.Handle("/fallback/", h)
+		mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("other")) })
+		s := httptest.NewServer(mux)
+
+		body, _ := proto.Marshal(&healthpb.HealthCheckRequest{})
+		tests := []struct {
+			name   string
+			method string
+			path   string
+			want   int
+		}{
+			{name: "method", method: http.MethodPost, path: "/fallback/$rpc/grpc.health.v1.Health/Check", want: http.StatusOK},
+			{name: "health", method: http.MethodGet, path: "/fallback" + healthzPath, want: http.StatusOK},
+			{name: "readiness", method: http.MethodGet, path: "/fallback" + readyzPath, want: http.StatusOK},
+			{name: "unprefixed", method: http.MethodPost, path: "/$rpc/grpc.health.v1.Health/Check", want: http.StatusNotFound},
+			{name: "metrics", method: http.MethodGet, path: "/fallback" + defaultMetricsPath, want: http.StatusOK},
+			{name: "other", method: http.MethodGet, path: "/other", want: http.StatusOK},
+		}
+		for _, tt := range tests {
+			req, _ := http.NewRequest(tt.method, s.URL+tt.path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", protoType)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, tt.name, err)
+			}
+			got, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != tt.want {
+				t.Errorf("%s %s: got = %d, want = %d (%s)", name, tt.name, res.StatusCode, tt.want, got)
+			}
+			if tt.name == "method" {
+				var hres healthpb.HealthCheckResponse
+				if err := proto.Unmarshal(got, &hres); err != nil || hres.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+					t.Errorf("%s %s: got = %v, want = SERVING (err = %v)", name, tt.name, hres.GetStatus(), err)
+				}
+			}
+		}
+		s.Close()
+	}
+
+	// only the connections dialed by the handlers are closed
+	if err := h.Close(); err != nil {
+		t.Errorf("NewHandler() Close(): got err = %v, want = nil", err)
+	}
+	if got := cc.GetState(); got == connectivity.Shutdown {
+		t.Errorf("NewHandler() Close(): got state = %v, want the caller's connection open", got)
+	}
+	if err := target.Close(); err != nil {
+		t.Errorf("NewTargetHandler() Close(): got err = %v, want = nil", err)
+	}
+	if len(target.f.dialed) != 1 || target.f.dialed[0].GetState() != connectivity.Shutdown {
+		t.Errorf("NewTargetHandler() Close(): got dialed = %v, want one closed connection", target.f.dialed)
+	}
+}
+
+func TestNewTargetHandler_errors(t *testing.T) {
+	_, err := NewTargetHandler("", WithRoutes(Route{Service: "a.B"}))
+	if err == nil || !strings.Contains(err.Error(), "error dialing gRPC backend server") {
+		t.Errorf("NewTargetHandler(): got err = %v, want = error dialing gRPC backend server", err)
+	}
+}
+
+func Test_cleanPathPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		prefix, want string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"api", "/api"},
+		{"/api/", "/api"},
+		{"/api/v1", "/api/v1"},
+	} {
+		if got := cleanPathPrefix(tt.prefix); got != tt.want {
+			t.Errorf("cleanPathPrefix(%q): got = %q, want = %q", tt.prefix, got, tt.want)
+		}
+	}
+}
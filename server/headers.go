@@ -0,0 +1,187 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// HeaderPolicy selects the request headers forwarded to the gRPC backend
+// as metadata. Header names are matched case-insensitively. Hop-by-hop
+// headers, and those reserved by gRPC itself, are never forwarded.
+type HeaderPolicy struct {
+	// Allow, AllowPrefixes and AllowPatterns select the headers to forward
+	// by exact name, name prefix, or regular expression matched against
+	// the lower case name, respectively.
+	Allow         []string
+	AllowPrefixes []string
+	AllowPatterns []*regexp.Regexp
+
+	// Deny, DenyPrefixes and DenyPatterns select headers that are not
+	// forwarded, even if they are allowed.
+	Deny         []string
+	DenyPrefixes []string
+	DenyPatterns []*regexp.Regexp
+
+	// Rename maps header names to the metadata keys they are forwarded as.
+	// Renamed headers are forwarded unless denied.
+	Rename map[string]string
+}
+
+// DefaultHeaderPolicy returns the policy used by default, which forwards
+// the Authorization header and x-goog-* headers.
+func DefaultHeaderPolicy() HeaderPolicy {
+	return HeaderPolicy{
+		Allow:         []string{"authorization"},
+		AllowPrefixes: []string{"x-goog-"},
+	}
+}
+
+// hopByHopHeaders are only meaningful for a single HTTP connection.
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"proxy-connection",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// reservedHeaders are set by gRPC itself, and break RPCs if forwarded.
+var reservedHeaders = []string{
+	"content-type",
+	"content-length",
+	"host",
+}
+
+// validKey matches the metadata keys allowed by gRPC.
+var validKey = regexp.MustCompile(`^[0-9a-z_.-]+$`)
+
+// headerPolicy returns the server's HeaderPolicy, defaulting to DefaultHeaderPolicy.
+func (f *FallbackServer) headerPolicy() *HeaderPolicy {
+	if f.headers == nil {
+		p := DefaultHeaderPolicy()
+		return &p
+	}
+
+	return f.headers
+}
+
+// prepareHeaders adds the request headers selected by the server's
+// HeaderPolicy to the outgoing metadata of the context.
+func (f *FallbackServer) prepareHeaders(ctx context.Context, hdr http.Header) context.Context {
+	out, _ := metadata.FromOutgoingContext(ctx)
+
+	return metadata.NewOutgoingContext(ctx, metadata.Join(out, f.headerPolicy().metadata(hdr)))
+}
+
+// metadata converts the headers selected by the policy into metadata.
+// The values of binary "-bin" keys are base64 decoded, with or without
+// padding, and dropped if they are not valid base64.
+func (p *HeaderPolicy) metadata(hdr http.Header) metadata.MD {
+	// headers listed in Connection are hop-by-hop too
+	skip := append([]string{}, hopByHopHeaders...)
+	skip = append(skip, reservedHeaders...)
+	for _, v := range hdr["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			skip = append(skip, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+
+	md := metadata.MD{}
+	for k, vs := range hdr {
+		name := strings.ToLower(k)
+		if contains(skip, name) || strings.HasPrefix(name, "grpc-") {
+			continue
+		}
+
+		key, renamed := p.rename(name)
+		if p.denied(name) || (!renamed && !p.allowed(name)) || !validKey.MatchString(key) {
+			continue
+		}
+
+		for _, v := range vs {
+			if strings.HasSuffix(key, "-bin") {
+				b, err := decodeBinaryHeader(v)
+				if err != nil {
+					continue
+				}
+				v = string(b)
+			}
+			md.Append(key, v)
+		}
+	}
+
+	return md
+}
+
+func (p *HeaderPolicy) allowed(name string) bool {
+	return matchHeader(name, p.Allow, p.AllowPrefixes, p.AllowPatterns)
+}
+
+func (p *HeaderPolicy) denied(name string) bool {
+	return matchHeader(name, p.Deny, p.DenyPrefixes, p.DenyPatterns)
+}
+
+// rename returns the metadata key of the header, and whether it was renamed.
+func (p *HeaderPolicy) rename(name string) (string, bool) {
+	for from, to := range p.Rename {
+		if strings.EqualFold(from, name) {
+			return strings.ToLower(to), true
+		}
+	}
+
+	return name, false
+}
+
+// matchHeader reports whether the lower case header name matches
+// any of the names, prefixes or patterns.
+func matchHeader(name string, names, prefixes []string, patterns []*regexp.Regexp) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	for _, re := range patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeBinaryHeader decodes a base64 header value, with or without padding.
+func decodeBinaryHeader(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+
+	return base64.RawStdEncoding.DecodeString(v)
+}
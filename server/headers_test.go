@@ -0,0 +1,147 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func Test_prepareHeaders(t *testing.T) {
+	type args struct {
+		ctx context.Context
+		hdr http.Header
+	}
+
+	parent := context.Background()
+	hdr := make(http.Header)
+	hdr.Add("Content-Type", "test")
+	hdr.Add("accept-encoding", "blah")
+	hdr.Add("content-length", "7")
+	hdr.Add("user-agent", "whoever")
+	hdr.Add("Authorization", "Bearer foo")
+	hdr.Add("x-goog-api-key", "bar")
+
+	want := map[string][]string{
+		"authorization":  []string{"Bearer foo"},
+		"x-goog-api-key": []string{"bar"},
+	}
+
+	tests := []struct {
+		name string
+		args args
+		want map[string][]string
+	}{
+		{name: "basic", want: want, args: args{hdr: hdr, ctx: parent}},
+		{
+			name: "existing metadata",
+			want: map[string][]string{
+				"authorization":  []string{"Bearer foo"},
+				"x-goog-api-key": []string{"bar"},
+				"x-existing":     []string{"baz"},
+			},
+			args: args{hdr: hdr, ctx: metadata.AppendToOutgoingContext(parent, "x-existing", "baz")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := (&FallbackServer{}).prepareHeaders(tt.args.ctx, tt.args.hdr)
+			got, _ := metadata.FromOutgoingContext(ctx)
+			if !reflect.DeepEqual(map[string][]string(got), tt.want) {
+				t.Errorf("prepareHeaders() %s: got = %v, want = %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderPolicy_metadata(t *testing.T) {
+	hdr := http.Header{
+		"Authorization":  {"Bearer foo"},
+		"X-Goog-Api-Key": {"bar"},
+		"X-Request-Id":   {"req-1"},
+		"Traceparent":    {"00-trace-span-01"},
+		"X-Tenant":       {"acme"},
+		"X-Tenant-Debug": {"1"},
+		"X-Trace-Bin":    {"AAE="},
+		"X-Raw-Bin":      {"AAE"},
+		"X-Invalid-Bin":  {"!!!"},
+		"Connection":     {"keep-alive, X-Hop"},
+		"Keep-Alive":     {"timeout=5"},
+		"X-Hop":          {"hop"},
+		"Upgrade":        {"websocket"},
+		"Content-Type":   {"application/x-protobuf"},
+		"Grpc-Timeout":   {"1S"},
+		"X-Bad!Name":     {"bad"},
+	}
+
+	tests := []struct {
+		name   string
+		policy HeaderPolicy
+		want   metadata.MD
+	}{
+		{
+			name:   "default",
+			policy: DefaultHeaderPolicy(),
+			want:   metadata.MD{"authorization": {"Bearer foo"}, "x-goog-api-key": {"bar"}},
+		},
+		{
+			name:   "allowlist",
+			policy: HeaderPolicy{Allow: []string{"X-Request-Id", "traceparent"}},
+			want:   metadata.MD{"x-request-id": {"req-1"}, "traceparent": {"00-trace-span-01"}},
+		},
+		{
+			name:   "prefix with denylist",
+			policy: HeaderPolicy{AllowPrefixes: []string{"X-Tenant"}, Deny: []string{"x-tenant-debug"}},
+			want:   metadata.MD{"x-tenant": {"acme"}},
+		},
+		{
+			name:   "patterns",
+			policy: HeaderPolicy{AllowPatterns: []*regexp.Regexp{regexp.MustCompile(`^x-.*-id$`), regexp.MustCompile(`^x-goog-`)}, DenyPatterns: []*regexp.Regexp{regexp.MustCompile(`key`)}},
+			want:   metadata.MD{"x-request-id": {"req-1"}},
+		},
+		{
+			name:   "binary headers",
+			policy: HeaderPolicy{AllowPrefixes: []string{"x-"}, DenyPrefixes: []string{"x-goog-", "x-tenant", "x-request"}},
+			want:   metadata.MD{"x-trace-bin": {"\x00\x01"}, "x-raw-bin": {"\x00\x01"}},
+		},
+		{
+			name:   "rename",
+			policy: HeaderPolicy{Allow: []string{"authorization"}, Rename: map[string]string{"X-Tenant": "tenant-id", "Authorization": "x-end-user-authorization"}},
+			want:   metadata.MD{"tenant-id": {"acme"}, "x-end-user-authorization": {"Bearer foo"}},
+		},
+		{
+			name:   "hop-by-hop and reserved",
+			policy: HeaderPolicy{AllowPatterns: []*regexp.Regexp{regexp.MustCompile(`.*`)}, DenyPrefixes: []string{"x-"}, Deny: []string{"authorization", "traceparent"}},
+			want:   metadata.MD{},
+		},
+		{
+			name:   "invalid metadata key",
+			policy: HeaderPolicy{Allow: []string{"x-bad!name"}, Rename: map[string]string{"x-tenant": "Tenant ID"}},
+			want:   metadata.MD{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.metadata(hdr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HeaderPolicy.metadata() %s: got = %q, want = %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
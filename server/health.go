@@ -0,0 +1,213 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	defaultReadinessTimeout = time.Second
+)
+
+// ReadinessPolicy configures how the /readyz endpoint decides
+// whether the backends of the server are ready to serve requests.
+// A backend is ready once its connection is established.
+type ReadinessPolicy struct {
+	// HealthCheck additionally requires the grpc.health.v1.Health/Check
+	// method of each backend to report that Service is SERVING.
+	HealthCheck bool
+
+	// Service is the name of the service checked, or empty
+	// for the health of the backend as a whole.
+	Service string
+
+	// Timeout bounds the time taken to check each backend, including
+	// connecting to it, and defaults to one second if not positive.
+	Timeout time.Duration
+}
+
+// backendConn is a connection that reports its connectivity,
+// as a grpc.ClientConn does.
+type backendConn interface {
+	connection
+	Target() string
+	GetState() connectivity.State
+	Connect()
+	WaitForStateChange(ctx context.Context, state connectivity.State) bool
+}
+
+// healthStatus is the JSON body of the /healthz and /readyz endpoints.
+type healthStatus struct {
+	Status   string          `json:"status"`
+	Backends []backendStatus `json:"backends"`
+}
+
+// backendStatus is the status of a single backend connection.
+type backendStatus struct {
+	Host    string `json:"host,omitempty"`
+	Backend string `json:"backend"`
+	State   string `json:"state,omitempty"`
+	Serving string `json:"serving,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Ready   bool   `json:"ready"`
+
+	cc connection
+}
+
+// readinessPolicy returns the server's ReadinessPolicy,
+// defaulting to just checking connectivity.
+func (f *FallbackServer) readinessPolicy() *ReadinessPolicy {
+	if f.readiness == nil {
+		return &ReadinessPolicy{}
+	}
+
+	return f.readiness
+}
+
+// backends lists the connections of the server, and of its virtual hosts.
+func (f *FallbackServer) backends() []backendStatus {
+	backends := []backendStatus{}
+	add := func(host string, cc connection) {
+		if rc, ok := cc.(*routedConnection); ok {
+			for _, cc := range rc.backends() {
+				backends = append(backends, backendStatus{Host: host, cc: unwrapConnection(cc)})
+			}
+			return
+		}
+		if cc != nil {
+			backends = append(backends, backendStatus{Host: host, cc: unwrapConnection(cc)})
+		}
+	}
+
+	add("", f.cc)
+	for _, vh := range f.vhosts {
+		if vh.server != nil {
+			add(vh.host, vh.server.cc)
+		}
+	}
+
+	for i, b := range backends {
+		if bc, ok := b.cc.(backendConn); ok {
+			backends[i].Backend = bc.Target()
+		}
+	}
+
+	return backends
+}
+
+// healthz is the liveness endpoint, which succeeds as long as the server
+// is serving, reporting the current state of each backend connection.
+func (f *FallbackServer) healthz(w http.ResponseWriter, r *http.Request) {
+	backends := f.backends()
+	for i, b := range backends {
+		if bc, ok := b.cc.(backendConn); ok {
+			backends[i].State = bc.GetState().String()
+			backends[i].Ready = bc.GetState() == connectivity.Ready
+		}
+	}
+
+	writeHealth(w, http.StatusOK, healthStatus{Status: "ok", Backends: backends})
+}
+
+// readyz is the readiness endpoint, which only succeeds
+// if every backend is ready, according to the ReadinessPolicy.
+func (f *FallbackServer) readyz(w http.ResponseWriter, r *http.Request) {
+	p := f.readinessPolicy()
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+
+	backends := f.backends()
+	var wg sync.WaitGroup
+	for i := range backends {
+		wg.Add(1)
+		go func(b *backendStatus) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			p.check(ctx, b)
+		}(&backends[i])
+	}
+	wg.Wait()
+
+	st := healthStatus{Status: "ok", Backends: backends}
+	code := http.StatusOK
+	for _, b := range backends {
+		if !b.Ready {
+			st.Status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+
+	writeHealth(w, code, st)
+}
+
+// check determines whether the backend is ready, connecting to it if its
+// connection is idle, and checking its health if the policy asks for it.
+func (p *ReadinessPolicy) check(ctx context.Context, b *backendStatus) {
+	if bc, ok := b.cc.(backendConn); ok {
+		state := bc.GetState()
+		if state == connectivity.Idle {
+			bc.Connect()
+		}
+		for state == connectivity.Idle || state == connectivity.Connecting {
+			if !bc.WaitForStateChange(ctx, state) {
+				break
+			}
+			state = bc.GetState()
+		}
+
+		b.State = state.String()
+		if state != connectivity.Ready {
+			return
+		}
+	}
+
+	if !p.HealthCheck {
+		b.Ready = true
+		return
+	}
+
+	res := &healthpb.HealthCheckResponse{}
+	if err := b.cc.Invoke(ctx, "/grpc.health.v1.Health/Check", &healthpb.HealthCheckRequest{Service: p.Service}, res); err != nil {
+		b.Error = err.Error()
+		return
+	}
+
+	b.Serving = res.GetStatus().String()
+	b.Ready = res.GetStatus() == healthpb.HealthCheckResponse_SERVING
+}
+
+// writeHealth writes the given status as the JSON response.
+func writeHealth(w http.ResponseWriter, code int, st healthStatus) {
+	b, _ := json.Marshal(st)
+
+	w.Header().Set("Content-Type", jsonType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(b)
+}
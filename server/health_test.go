@@ -0,0 +1,137 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// unreachableBackend returns a connection to a backend that refuses connections.
+func unreachableBackend(t *testing.T) connection {
+	lis := bufconn.Listen(1024)
+	lis.Close()
+
+	return dialTestBackend(t, "unreachable", lis)
+}
+
+func TestFallbackServer_readyz(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   *FallbackServer
+		wantCode int
+		want     healthStatus
+	}{
+		{
+			name:     "ready",
+			server:   &FallbackServer{cc: testBackend(t, false)},
+			wantCode: http.StatusOK,
+			want:     healthStatus{Status: "ok", Backends: []backendStatus{{Backend: "bufnet", State: "READY", Ready: true}}},
+		},
+		{
+			name:     "serving",
+			server:   &FallbackServer{cc: testBackend(t, false), readiness: &ReadinessPolicy{HealthCheck: true}},
+			wantCode: http.StatusOK,
+			want:     healthStatus{Status: "ok", Backends: []backendStatus{{Backend: "bufnet", State: "READY", Serving: "SERVING", Ready: true}}},
+		},
+		{
+			name:     "health check failed",
+			server:   &FallbackServer{cc: testBackend(t, false), readiness: &ReadinessPolicy{HealthCheck: true, Service: "error"}},
+			wantCode: http.StatusServiceUnavailable,
+			want: healthStatus{Status: "unavailable", Backends: []backendStatus{
+				{Backend: "bufnet", State: "READY", Error: "rpc error: code = NotFound desc = unknown service"},
+			}},
+		},
+		{
+			name:     "unreachable",
+			server:   &FallbackServer{cc: unreachableBackend(t), readiness: &ReadinessPolicy{Timeout: 5 * time.Second}},
+			wantCode: http.StatusServiceUnavailable,
+			want:     healthStatus{Status: "unavailable", Backends: []backendStatus{{Backend: "unreachable", State: "TRANSIENT_FAILURE"}}},
+		},
+		{
+			name: "virtual hosts",
+			server: &FallbackServer{
+				cc: testBackend(t, false),
+				vhosts: []*virtualHost{
+					{host: "foo.example.test", server: &FallbackServer{cc: unreachableBackend(t)}},
+				},
+			},
+			wantCode: http.StatusServiceUnavailable,
+			want: healthStatus{Status: "unavailable", Backends: []backendStatus{
+				{Backend: "bufnet", State: "READY", Ready: true},
+				{Host: "foo.example.test", Backend: "unreachable", State: "TRANSIENT_FAILURE"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.server.readyz(w, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("FallbackServer.readyz() %s: got code = %d, want = %d", tt.name, w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Content-Type"); got != jsonType {
+				t.Errorf("FallbackServer.readyz() %s: got content type = %s, want = %s", tt.name, got, jsonType)
+			}
+
+			var got healthStatus
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("FallbackServer.readyz() %s: invalid body %q: %v", tt.name, w.Body, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FallbackServer.readyz() %s: got = %+v, want = %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_healthz(t *testing.T) {
+	f := &FallbackServer{cc: unreachableBackend(t)}
+
+	w := httptest.NewRecorder()
+	f.healthz(w, httptest.NewRequest(http.MethodGet, healthzPath, nil))
+
+	// liveness does not depend on the backend, nor connect to it
+	if w.Code != http.StatusOK {
+		t.Errorf("FallbackServer.healthz(): got code = %d, want = %d", w.Code, http.StatusOK)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"status":"ok","backends":[{"backend":"unreachable","state":"IDLE","ready":false}]}`; got != want {
+		t.Errorf("FallbackServer.healthz(): got = %s, want = %s", got, want)
+	}
+}
+
+func TestFallbackServer_preStart_health(t *testing.T) {
+	f := NewServer("0", "localhost:1234")
+	if err := f.preStart(); err != nil {
+		t.Fatalf("FallbackServer.preStart(): unexpected error: %v", err)
+	}
+
+	for _, path := range []string{healthzPath, readyzPath} {
+		w := httptest.NewRecorder()
+		f.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if got := w.Header().Get("Content-Type"); got != jsonType {
+			t.Errorf("FallbackServer.preStart() %s: got content type = %s, want = %s", path, got, jsonType)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// jsonHandler is a generic HTTP handler for grpc-fallback requests
+// carrying proto3 JSON payloads. The request and response messages
+// are transcoded to and from the protobuf binary format using the
+// descriptors of the invoked RPC.
+func (f *FallbackServer) jsonHandler(w http.ResponseWriter, r *http.Request) {
+	logger(r).Debug("Incoming grpc-fallback JSON request", "uri", r.RequestURI)
+	v := mux.Vars(r)
+
+	// allow the origins permitted by the CORS policy
+	f.corsPolicy().apply(w, r)
+	w.Header().Set("Content-Type", jsonType)
+
+	md, err := f.findMethod(v["service"], v["method"])
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+
+	// copy headers into out-going context metadata
+	m := buildMethod(v["service"], v["method"])
+	ctx, cancel, err := f.requestContext(r, m)
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	// stream the newline-delimited messages of client-streaming requests
+	if md.IsStreamingClient() {
+		f.clientStream(ctx, w, r, m, md, newNDJSONReader(r.Body, md.Input()), &jsonFramer{md: md})
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, r, status.Errorf(codes.InvalidArgument, "error reading request body: %v", err))
+		return
+	}
+
+	req, err := decodeJSON(md.Input(), body)
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+
+	if md.IsStreamingServer() {
+		f.serverStream(ctx, w, r, m, req, &jsonFramer{md: md})
+		return
+	}
+
+	var header, trailer metadata.MD
+	res := &bytes.Buffer{}
+	err = f.cc.Invoke(ctx, m, bytes.NewReader(req), res, grpc.Header(&header), grpc.Trailer(&trailer))
+	f.writeHeaderMetadata(w, header, trailer)
+	defer f.writeTrailerMetadata(w, trailer, false)
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+
+	b, err := encodeJSON(md.Output(), res.Bytes())
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+
+	w.Write(b)
+}
+
+// decodeJSON transcodes a proto3 JSON message of the given type into the
+// protobuf binary format. An empty payload is treated as the default message.
+func decodeJSON(md protoreflect.MessageDescriptor, b []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := protojson.Unmarshal(b, msg); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid JSON request body: %v", err)
+		}
+	}
+
+	return proto.Marshal(msg)
+}
+
+// encodeJSON transcodes a protobuf binary message of the given type into proto3 JSON.
+func encodeJSON(md protoreflect.MessageDescriptor, b []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid response from backend: %v", err)
+	}
+
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error encoding JSON response: %v", err)
+	}
+
+	return b, nil
+}
+
+// jsonStatus encodes the given status as a JSON google.rpc.Status.
+func jsonStatus(st *status.Status) []byte {
+	b, err := protojson.Marshal(st.Proto())
+	if err != nil {
+		// the details may contain types that cannot be
+		// resolved, so fallback to just the code and message
+		b, _ = protojson.Marshal(status.New(st.Code(), st.Message()).Proto())
+	}
+
+	return b
+}
+
+// writeJSONError writes the given error to the response as a JSON
+// encoded google.rpc.Status, along with the corresponding HTTP status.
+func writeJSONError(w http.ResponseWriter, r *http.Request, err error) {
+	logger(r).Debug("Error handling request", "uri", r.RequestURI, "error", err)
+
+	st, _ := status.FromError(err)
+	recordCode(r, st.Code())
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	w.Write(jsonStatus(st))
+}
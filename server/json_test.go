@@ -0,0 +1,124 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestFallbackServer_jsonHandler(t *testing.T) {
+	serving, _ := proto.Marshal(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+	wantReq, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "foo"})
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		cc       *testConnection
+		wantReq  []byte
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "basic",
+			path:     "/$rpc/grpc.health.v1.Health/Check",
+			body:     `{"service": "foo"}`,
+			cc:       &testConnection{res: serving},
+			wantReq:  wantReq,
+			wantCode: http.StatusOK,
+			wantBody: `{"status":"SERVING"}`,
+		},
+		{
+			name:     "empty body",
+			path:     "/$rpc/grpc.health.v1.Health/Check",
+			cc:       &testConnection{res: serving},
+			wantReq:  []byte{},
+			wantCode: http.StatusOK,
+			wantBody: `{"status":"SERVING"}`,
+		},
+		{
+			name:     "invalid body",
+			path:     "/$rpc/grpc.health.v1.Health/Check",
+			body:     `{"unknown": 1}`,
+			cc:       &testConnection{},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unknown method",
+			path:     "/$rpc/grpc.health.v1.Health/Nope",
+			cc:       &testConnection{},
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "gRPC error status",
+			path:     "/$rpc/grpc.health.v1.Health/Check",
+			cc:       &testConnection{err: status.Error(codes.PermissionDenied, "test")},
+			wantCode: http.StatusForbidden,
+			wantBody: `{"code":7,"message":"test"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: tt.cc}
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.jsonHandler)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", jsonType)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.wantCode {
+				t.Errorf("jsonHandler() %s code: got = %d, want = %d", tt.name, resp.Code, tt.wantCode)
+			}
+
+			if ct := resp.Header().Get("Content-Type"); ct != jsonType {
+				t.Errorf("jsonHandler() %s content-type: got = %s, want = %s", tt.name, ct, jsonType)
+			}
+
+			if tt.wantReq != nil && string(tt.cc.req) != string(tt.wantReq) {
+				t.Errorf("jsonHandler() %s request: got = %v, want = %v", tt.name, tt.cc.req, tt.wantReq)
+			}
+
+			if resp.Code != http.StatusOK {
+				// errors must always be a JSON encoded google.rpc.Status
+				if err := protojson.Unmarshal(resp.Body.Bytes(), &statuspb.Status{}); err != nil {
+					t.Errorf("jsonHandler() %s: error body is not a google.rpc.Status: %v", tt.name, err)
+				}
+			}
+
+			if tt.wantBody != "" && compactJSON(resp.Body.String()) != tt.wantBody {
+				t.Errorf("jsonHandler() %s body: got = %s, want = %s", tt.name, resp.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// compactJSON strips the whitespace protojson randomly inserts into its output.
+func compactJSON(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
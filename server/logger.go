@@ -0,0 +1,63 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// Logger receives the log messages of a FallbackServer, each made up
+// of a message and alternating keys and values, at one of four levels.
+// It is satisfied by *slog.Logger.
+//
+// Messages about individual requests are logged at the debug level,
+// so they are quiet unless the Logger is configured otherwise.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type loggerKey struct{}
+
+// log returns the server's Logger, defaulting to the default slog.Logger.
+func (f *FallbackServer) log() Logger {
+	if f.logger == nil {
+		return slog.Default()
+	}
+
+	return f.logger
+}
+
+// withLogger is middleware making the server's Logger
+// available to request handlers via the request context.
+func (f *FallbackServer) withLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), loggerKey{}, f.log())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// logger returns the Logger of the server handling the request.
+func logger(r *http.Request) Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+
+	return slog.Default()
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// ResponseMetadataPolicy selects the header and trailer metadata of
+// backend responses that is written to HTTP responses. Metadata reserved
+// by gRPC, like content-type and grpc-* keys, and CORS headers are never
+// written.
+type ResponseMetadataPolicy struct {
+	// Filter selects the metadata keys written, and renames them,
+	// just like a HeaderPolicy does for request headers.
+	Filter HeaderPolicy
+
+	// HeaderPrefix and TrailerPrefix are prepended to the names of
+	// the HTTP headers carrying header and trailer metadata.
+	HeaderPrefix  string
+	TrailerPrefix string
+
+	// Trailers writes trailer metadata as HTTP trailers, instead of HTTP
+	// headers. The trailer metadata of streamed responses is always written
+	// as HTTP trailers, as it arrives after the headers have been sent.
+	Trailers bool
+}
+
+// DefaultResponseMetadataPolicy returns the policy used by default,
+// which writes all header and trailer metadata as HTTP headers.
+func DefaultResponseMetadataPolicy() ResponseMetadataPolicy {
+	return ResponseMetadataPolicy{
+		Filter: HeaderPolicy{AllowPatterns: []*regexp.Regexp{regexp.MustCompile(`.*`)}},
+	}
+}
+
+// responseMetadata returns the server's ResponseMetadataPolicy,
+// defaulting to DefaultResponseMetadataPolicy.
+func (f *FallbackServer) responseMetadata() *ResponseMetadataPolicy {
+	if f.respMetadata == nil {
+		p := DefaultResponseMetadataPolicy()
+		return &p
+	}
+
+	return f.respMetadata
+}
+
+// writeHeaderMetadata writes the header metadata of a response as HTTP
+// headers, before the response body is written. The trailer metadata of
+// a response that is not streamed is included, unless it is to be written
+// as HTTP trailers, in which case the trailers are declared instead.
+func (f *FallbackServer) writeHeaderMetadata(w http.ResponseWriter, header, trailer metadata.MD) {
+	p := f.responseMetadata()
+	p.write(w.Header(), header, p.HeaderPrefix)
+
+	trailers := make(http.Header)
+	p.write(trailers, trailer, p.TrailerPrefix)
+	for k, vs := range trailers {
+		if p.Trailers {
+			// declared trailers keep the response from being
+			// sent with a Content-Length, and without trailers
+			w.Header().Add("Trailer", k)
+		} else {
+			w.Header()[k] = append(w.Header()[k], vs...)
+		}
+	}
+}
+
+// writeTrailerMetadata writes the trailer metadata of a response as HTTP
+// trailers, once the response body has been written, if it is streamed
+// or the policy asks for it.
+func (f *FallbackServer) writeTrailerMetadata(w http.ResponseWriter, trailer metadata.MD, streamed bool) {
+	p := f.responseMetadata()
+	if !streamed && !p.Trailers {
+		return
+	}
+
+	// trailers that were not declared are marked by prefixing their names
+	for k, vs := range p.trailers(trailer) {
+		w.Header()[http.TrailerPrefix+k] = vs
+	}
+}
+
+// trailers returns the trailer metadata selected by the policy,
+// as HTTP headers.
+func (p *ResponseMetadataPolicy) trailers(md metadata.MD) http.Header {
+	hdr := make(http.Header)
+	p.write(hdr, md, p.TrailerPrefix)
+
+	return hdr
+}
+
+// write adds the metadata selected by the policy to the headers, with
+// the given prefix. Values of binary "-bin" keys are base64 encoded.
+func (p *ResponseMetadataPolicy) write(hdr http.Header, md metadata.MD, prefix string) {
+	for k, vs := range md {
+		// CORS headers are set by the server's own policy
+		if contains(hopByHopHeaders, k) || contains(reservedHeaders, k) || strings.HasPrefix(k, "grpc-") || strings.HasPrefix(k, "access-control-") {
+			continue
+		}
+
+		key, renamed := p.Filter.rename(k)
+		if p.Filter.denied(k) || (!renamed && !p.Filter.allowed(k)) {
+			continue
+		}
+
+		for _, v := range vs {
+			if strings.HasSuffix(key, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			hdr.Add(prefix+key, v)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestResponseMetadataPolicy_write(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ResponseMetadataPolicy
+		prefix string
+		want   http.Header
+	}{
+		{
+			name:   "default",
+			policy: DefaultResponseMetadataPolicy(),
+			want:   http.Header{"X-Test-Header": {"value"}, "X-Test-Bin": {"AAE="}},
+		},
+		{
+			name:   "prefix",
+			policy: DefaultResponseMetadataPolicy(),
+			prefix: "Grpc-Metadata-",
+			want:   http.Header{"Grpc-Metadata-X-Test-Header": {"value"}, "Grpc-Metadata-X-Test-Bin": {"AAE="}},
+		},
+		{
+			name:   "filter",
+			policy: ResponseMetadataPolicy{Filter: HeaderPolicy{AllowPrefixes: []string{"x-test-"}, Deny: []string{"x-test-bin"}, Rename: map[string]string{"x-test-header": "x-renamed"}}},
+			want:   http.Header{"X-Renamed": {"value"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(http.Header)
+			tt.policy.write(got, testHeader, tt.prefix)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResponseMetadataPolicy.write() %s: got = %q, want = %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_responseMetadata(t *testing.T) {
+	cc := testBackend(t, false)
+
+	tests := []struct {
+		name        string
+		policy      *ResponseMetadataPolicy
+		method      string
+		contentType string
+		service     string
+		wantHeader  http.Header
+		wantTrailer http.Header
+	}{
+		{
+			name:       "unary",
+			method:     "Check",
+			service:    "metadata",
+			wantHeader: http.Header{"X-Test-Header": {"value"}, "X-Test-Bin": {"AAE="}, "X-Test-Trailer": {"done"}},
+		},
+		{
+			name:        "unary with trailers",
+			policy:      &ResponseMetadataPolicy{Filter: DefaultResponseMetadataPolicy().Filter, HeaderPrefix: "Grpc-Metadata-", TrailerPrefix: "Grpc-Trailer-", Trailers: true},
+			method:      "Check",
+			service:     "metadata",
+			wantHeader:  http.Header{"Grpc-Metadata-X-Test-Header": {"value"}, "Grpc-Metadata-X-Test-Bin": {"AAE="}},
+			wantTrailer: http.Header{"Grpc-Trailer-X-Test-Trailer": {"done"}},
+		},
+		{
+			name:        "unary JSON",
+			method:      "Check",
+			contentType: jsonType,
+			service:     "metadata",
+			wantHeader:  http.Header{"X-Test-Header": {"value"}, "X-Test-Bin": {"AAE="}, "X-Test-Trailer": {"done"}},
+		},
+		{
+			name:        "server streaming",
+			method:      "Watch",
+			service:     "metadata",
+			wantHeader:  http.Header{"X-Test-Header": {"value"}, "X-Test-Bin": {"AAE="}},
+			wantTrailer: http.Header{"X-Test-Trailer": {"done"}},
+		},
+		{
+			name:       "none",
+			method:     "Check",
+			wantHeader: http.Header{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: cc, respMetadata: tt.policy}
+
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.handler).Headers("Content-Type", protoType)
+			r.HandleFunc(fallbackPath, f.jsonHandler).Headers("Content-Type", jsonType)
+			s := httptest.NewServer(r)
+			defer s.Close()
+
+			ct := protoType
+			body, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: tt.service})
+			if tt.contentType == jsonType {
+				ct = jsonType
+				body = []byte(`{"service": "` + tt.service + `"}`)
+			}
+
+			res, err := http.Post(s.URL+"/$rpc/grpc.health.v1.Health/"+tt.method, ct, bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("responseMetadata() %s: %v", tt.name, err)
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("responseMetadata() %s: got = %d, want = %d", tt.name, res.StatusCode, http.StatusOK)
+			}
+
+			gotHeader := make(http.Header)
+			for k, v := range res.Header {
+				if strings.HasPrefix(k, "X-Test-") || strings.HasPrefix(k, "Grpc-") {
+					gotHeader[k] = v
+				}
+			}
+			if !reflect.DeepEqual(gotHeader, tt.wantHeader) {
+				t.Errorf("responseMetadata() %s header: got = %q, want = %q", tt.name, gotHeader, tt.wantHeader)
+			}
+
+			gotTrailer := res.Trailer
+			if len(gotTrailer) == 0 {
+				gotTrailer = nil
+			}
+			if !reflect.DeepEqual(gotTrailer, tt.wantTrailer) {
+				t.Errorf("responseMetadata() %s trailer: got = %q, want = %q", tt.name, gotTrailer, tt.wantTrailer)
+			}
+		})
+	}
+}
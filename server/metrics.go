@@ -0,0 +1,237 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	defaultMetricsPath = "/metrics"
+	metricsNamespace   = "fallback_proxy"
+
+	// unknownLabel is the service and method label of requests
+	// for methods unknown to the server
+	unknownLabel = "unknown"
+)
+
+// connectivityStates are the states reported for each backend connection.
+var connectivityStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+// proxyMetrics are the Prometheus metrics of the requests proxied by
+// a server, and of its backend connections, along with where they
+// are exposed.
+type proxyMetrics struct {
+	path string
+	addr string
+
+	// admin serves the metrics when they have an address of their own
+	admin *http.Server
+
+	registry  *prometheus.Registry
+	requests  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+	reqSizes  *prometheus.HistogramVec
+	resSizes  *prometheus.HistogramVec
+}
+
+// newProxyMetrics registers the metrics of the server, including the
+// state of its backends, and those of the Go runtime and the process.
+func newProxyMetrics(f *FallbackServer, path, addr string) *proxyMetrics {
+	if path == "" {
+		path = defaultMetricsPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	labels := []string{"service", "method", "code", "status"}
+	sizes := prometheus.ExponentialBuckets(64, 4, 10)
+	m := &proxyMetrics{
+		path:     path,
+		addr:     addr,
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Number of requests proxied, by gRPC method, status code and HTTP status.",
+		}, labels),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle proxied requests, including streaming their responses.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		reqSizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_size_bytes",
+			Help:      "Size of the bodies of proxied requests.",
+			Buckets:   sizes,
+		}, labels),
+		resSizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "response_size_bytes",
+			Help:      "Size of the bodies of responses to proxied requests.",
+			Buckets:   sizes,
+		}, labels),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.durations,
+		m.reqSizes,
+		m.resSizes,
+		backendCollector{
+			f: f,
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(metricsNamespace, "", "backend_connections"),
+				"Number of backend connections in each connectivity state.",
+				[]string{"host", "backend", "state"}, nil),
+		},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// handler serves the metrics in the Prometheus exposition format.
+func (m *proxyMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// startAdmin serves the metrics on their own address, if they have one,
+// returning once it is listening.
+func (f *FallbackServer) startAdmin() error {
+	if f.metrics == nil || f.metrics.addr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", f.metrics.addr)
+	if err != nil {
+		return fmt.Errorf("error listening for metrics on %s: %v", f.metrics.addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(f.metrics.path, f.metrics.handler())
+	admin := &http.Server{Handler: mux}
+	f.mu.Lock()
+	f.metrics.admin = admin
+	f.mu.Unlock()
+
+	f.log().Info("Metrics listening", "address", l.Addr().String())
+	go func() {
+		if err := admin.Serve(l); err != nil && err != http.ErrServerClosed {
+			f.log().Error("Error in metrics server while serving", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// shutdownAdmin turns down the server of the metrics, if any.
+func (f *FallbackServer) shutdownAdmin(ctx context.Context) error {
+	if f.metrics == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	admin := f.metrics.admin
+	f.mu.Unlock()
+	if admin == nil {
+		return nil
+	}
+
+	return admin.Shutdown(ctx)
+}
+
+// backendCollector reports the connectivity state of the backends
+// of a server as it is scraped.
+type backendCollector struct {
+	f    *FallbackServer
+	desc *prometheus.Desc
+}
+
+func (c backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect counts the connections to each backend by their state, as routes
+// may connect to the same backend with different transport security.
+func (c backendCollector) Collect(ch chan<- prometheus.Metric) {
+	type backend struct{ host, target string }
+	var backends []backend
+	counts := make(map[backend]map[connectivity.State]int)
+	for _, b := range c.f.backends() {
+		bc, ok := b.cc.(backendConn)
+		if !ok {
+			continue
+		}
+
+		key := backend{b.Host, b.Backend}
+		if counts[key] == nil {
+			backends = append(backends, key)
+			counts[key] = make(map[connectivity.State]int)
+		}
+		counts[key][bc.GetState()]++
+	}
+
+	for _, b := range backends {
+		for _, state := range connectivityStates {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+				float64(counts[b][state]), b.host, b.target, state.String())
+		}
+	}
+}
+
+// observe records the outcome, duration and sizes of a request. Requests
+// for methods known not to be served, or that the backend answered are
+// unimplemented, are labeled as unknown, rather than by the names given
+// by clients, which would otherwise create any number of series.
+func (m *proxyMetrics) observe(rec *requestRecord) {
+	service, method := rec.service, rec.method
+	if !rec.known || rec.code == codes.Unimplemented {
+		service, method = unknownLabel, unknownLabel
+	}
+
+	labels := prometheus.Labels{
+		"service": service,
+		"method":  method,
+		"code":    rec.code.String(),
+		"status":  strconv.Itoa(rec.status),
+	}
+	m.requests.With(labels).Inc()
+	m.durations.With(labels).Observe(rec.latency.Seconds())
+	m.reqSizes.With(labels).Observe(float64(rec.reqSize))
+	m.resSizes.With(labels).Observe(float64(rec.resSize))
+}
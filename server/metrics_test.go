@@ -0,0 +1,170 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestFallbackServer_metrics(t *testing.T) {
+	f := &FallbackServer{cc: testBackend(t, false)}
+	f.metrics = newProxyMetrics(f, "", "")
+
+	r := mux.NewRouter()
+	r.Use(f.withRecord)
+	r.Handle(f.metrics.path, f.metrics.handler())
+	r.HandleFunc(healthzPath, f.healthz)
+	r.HandleFunc(fallbackPath, f.handler).Headers("Content-Type", protoType)
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	for _, service := range []string{"", "", "error"} {
+		body, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: service})
+		res, err := http.Post(s.URL+"/$rpc/grpc.health.v1.Health/Check", protoType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("withMetrics() %q: %v", service, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if res, err := http.Get(s.URL + healthzPath); err == nil {
+		res.Body.Close()
+	}
+
+	// methods unknown to the server are not labeled by name
+	for _, path := range []string{"/$rpc/a.B/C", "/$rpc/d.E/F"} {
+		if res, err := http.Post(s.URL+path, protoType, nil); err == nil {
+			res.Body.Close()
+		}
+	}
+
+	res, err := http.Get(s.URL + defaultMetricsPath)
+	if err != nil {
+		t.Fatalf("withMetrics() scrape: %v", err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	got := string(b)
+
+	for _, want := range []string{
+		`fallback_proxy_requests_total{code="OK",method="Check",service="grpc.health.v1.Health",status="200"} 2`,
+		`fallback_proxy_requests_total{code="NotFound",method="Check",service="grpc.health.v1.Health",status="404"} 1`,
+		`fallback_proxy_request_duration_seconds_count{code="OK",method="Check",service="grpc.health.v1.Health",status="200"} 2`,
+		`fallback_proxy_request_size_bytes_sum{code="NotFound",method="Check",service="grpc.health.v1.Health",status="404"} 7`,
+		`fallback_proxy_response_size_bytes_sum{code="OK",method="Check",service="grpc.health.v1.Health",status="200"} 4`,
+		`fallback_proxy_backend_connections{backend="bufnet",host="",state="READY"} 1`,
+		`fallback_proxy_backend_connections{backend="bufnet",host="",state="IDLE"} 0`,
+		`fallback_proxy_requests_total{code="Unimplemented",method="unknown",service="unknown",status="501"} 2`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("withMetrics(): missing %s in:\n%s", want, got)
+		}
+	}
+
+	// only requests for gRPC methods are observed
+	if strings.Contains(got, `service=""`) {
+		t.Errorf("withMetrics(): got unexpected observation of other requests in:\n%s", got)
+	}
+	if strings.Contains(got, `service="a.B"`) {
+		t.Errorf("withMetrics(): got unexpected labels of unknown methods in:\n%s", got)
+	}
+}
+
+func TestFallbackServer_metrics_unregisteredMethod(t *testing.T) {
+	// the backend serves a method whose descriptors are not linked into
+	// the proxy, and answers that any other method is unimplemented
+	f := &FallbackServer{cc: testBackend(t, false, grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		if m, _ := grpc.MethodFromServerStream(stream); m != "/test.Echo/Echo" {
+			return status.Errorf(codes.Unimplemented, "unknown method %s", m)
+		}
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		return stream.SendMsg(&emptypb.Empty{})
+	}))}
+	f.metrics = newProxyMetrics(f, "", "")
+
+	r := mux.NewRouter()
+	r.Use(f.withRecord)
+	r.Handle(f.metrics.path, f.metrics.handler())
+	r.HandleFunc(fallbackPath, f.handler).Headers("Content-Type", protoType)
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	for _, path := range []string{"/$rpc/test.Echo/Echo", "/$rpc/test.Echo/Nope"} {
+		if res, err := http.Post(s.URL+path, protoType, nil); err == nil {
+			res.Body.Close()
+		}
+	}
+
+	res, err := http.Get(s.URL + defaultMetricsPath)
+	if err != nil {
+		t.Fatalf("withMetrics() scrape: %v", err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	got := string(b)
+
+	for _, want := range []string{
+		`fallback_proxy_requests_total{code="OK",method="Echo",service="test.Echo",status="200"} 1`,
+		`fallback_proxy_requests_total{code="Unimplemented",method="unknown",service="unknown",status="501"} 1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("withMetrics() unregistered method: missing %s in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `method="Nope"`) {
+		t.Errorf("withMetrics() unregistered method: got unexpected labels of unimplemented methods in:\n%s", got)
+	}
+}
+
+func TestFallbackServer_preStart_metrics(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+		want int
+	}{
+		{name: "server", opt: WithMetrics("", ""), want: http.StatusOK},
+		{name: "custom path", opt: WithMetrics("stats", ""), want: http.StatusNotFound},
+		{name: "admin address", opt: WithMetrics("", "localhost:0"), want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		f := NewServer("0", "localhost:1234", tt.opt)
+		if err := f.preStart(); err != nil {
+			t.Fatalf("FallbackServer.preStart() %s: unexpected error: %v", tt.name, err)
+		}
+
+		w := httptest.NewRecorder()
+		f.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultMetricsPath, nil))
+		if w.Code != tt.want {
+			t.Errorf("FallbackServer.preStart() %s: got code = %d, want = %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
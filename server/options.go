@@ -0,0 +1,233 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Option customizes a FallbackServer created by NewServer.
+type Option func(*FallbackServer)
+
+// WithReflection resolves the descriptors of proxied services using the
+// gRPC server reflection API of the backend. Descriptors are cached for
+// the given TTL, or a default of five minutes if it is not positive.
+//
+// With descriptors available, requests for methods the backend does
+// not serve are rejected with a NOT_FOUND status before reaching it.
+func WithReflection(ttl time.Duration) Option {
+	return func(f *FallbackServer) {
+		f.reflection = true
+		f.reflectionTTL = ttl
+	}
+}
+
+// WithDescriptorSource resolves the descriptors of proxied services using
+// the given DescriptorSource, such as one created by LoadDescriptorSets.
+// Multiple sources are consulted in the order they are given, before
+// server reflection, if enabled.
+//
+// With descriptors available, requests for methods the backend does
+// not serve are rejected with a NOT_FOUND status before reaching it.
+func WithDescriptorSource(src DescriptorSource) Option {
+	return func(f *FallbackServer) {
+		f.sources = append(f.sources, src)
+	}
+}
+
+// WithRESTRoutes routes REST requests to the methods of the proxied services
+// that have google.api.http annotations, transcoding JSON request and response
+// bodies. Routes are derived from the descriptors available when the server
+// starts, which requires a DescriptorSource able to list its services, like
+// those of server reflection, descriptor sets, or the binary's own registry.
+func WithRESTRoutes() Option {
+	return func(f *FallbackServer) {
+		f.rest = true
+	}
+}
+
+// WithDialOptions adds the given options to those used to dial the gRPC
+// backend. They are applied after the defaults, so they can override the
+// transport credentials chosen for the backend, for example.
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(f *FallbackServer) {
+		f.dialOpts = append(f.dialOpts, opts...)
+	}
+}
+
+// WithHeaderPolicy forwards the request headers selected by the given
+// policy to the gRPC backend as metadata, instead of those selected by
+// DefaultHeaderPolicy.
+func WithHeaderPolicy(p HeaderPolicy) Option {
+	return func(f *FallbackServer) {
+		f.headers = &p
+	}
+}
+
+// WithResponseMetadata writes the header and trailer metadata of backend
+// responses selected by the given policy to HTTP responses, instead of
+// following DefaultResponseMetadataPolicy.
+func WithResponseMetadata(p ResponseMetadataPolicy) Option {
+	return func(f *FallbackServer) {
+		f.respMetadata = &p
+	}
+}
+
+// WithRoutes sends the requests for the services matched by the given
+// routes to their backends, instead of the server's default backend.
+// Requests for services without a route are sent to the default backend,
+// or rejected with a NOT_FOUND status if the server has none.
+func WithRoutes(routes ...Route) Option {
+	return func(f *FallbackServer) {
+		f.routes = append(f.routes, routes...)
+	}
+}
+
+// WithVirtualHost proxies the requests for the given host to its own
+// backend, with the server customized by the given options. The host is
+// matched against the Host header of requests, ignoring the port, and may
+// have a leading "*." wildcard, like "*.example.test". Hosts inherit the
+// settings of the server, such as its CORS and header policies, unless
+// their options override them. Options of the HTTP server itself, like
+// WithTLS and WithListener, have no effect on hosts.
+//
+// The server's own backend proxies the requests for any other host, and
+// may be empty to only serve virtual hosts.
+func WithVirtualHost(host, backend string, opts ...Option) Option {
+	return func(f *FallbackServer) {
+		f.vhosts = append(f.vhosts, &virtualHost{host: host, backend: backend, opts: opts})
+	}
+}
+
+// WithReadinessPolicy decides whether the backends are ready to serve
+// requests, as reported by the /readyz endpoint, according to the given
+// policy, instead of just by the state of their connections.
+func WithReadinessPolicy(p ReadinessPolicy) Option {
+	return func(f *FallbackServer) {
+		f.readiness = &p
+	}
+}
+
+// WithMetrics exports Prometheus metrics of the proxied requests, by method,
+// gRPC status code and HTTP status, and of the state of backend connections,
+// on the given path, or /metrics if it is empty. The metrics are served by a
+// separate HTTP server listening on addr, such as an admin port, or by the
+// server itself if addr is empty.
+func WithMetrics(path, addr string) Option {
+	return func(f *FallbackServer) {
+		f.metrics = newProxyMetrics(f, path, addr)
+	}
+}
+
+// WithTracing creates an OpenTelemetry span for each proxied request, named
+// after its method, as a child of the trace context of the request headers.
+// The context of the span is propagated to the backend as metadata.
+func WithTracing(t Tracing) Option {
+	return func(f *FallbackServer) {
+		f.tracing = &t
+	}
+}
+
+// WithDeadlinePolicy caps the deadlines of backend calls, which are
+// otherwise only set by the X-Server-Timeout or grpc-timeout headers
+// of requests, according to the given policy.
+func WithDeadlinePolicy(p DeadlinePolicy) Option {
+	return func(f *FallbackServer) {
+		f.deadlines = &p
+	}
+}
+
+// WithTransportSecurity secures the connection to the gRPC backend with
+// the given settings. Without it, connections to backends on localhost
+// are plaintext, while others use TLS with the system's root CAs.
+func WithTransportSecurity(ts TransportSecurity) Option {
+	return func(f *FallbackServer) {
+		f.transport = &ts
+	}
+}
+
+// WithPathPrefix serves the endpoints of the server, including those of the
+// health checks and metrics, under the given path prefix, such as "/api" for
+// "/api/$rpc/{service}/{method}", to mount them alongside other handlers.
+func WithPathPrefix(prefix string) Option {
+	return func(f *FallbackServer) {
+		f.pathPrefix = cleanPathPrefix(prefix)
+	}
+}
+
+// WithHTTPServer serves requests using the given HTTP server, to configure
+// its timeouts or TLS, for example. Its Handler is replaced by the server's
+// router on start, and its Addr defaults to the port given to NewServer.
+func WithHTTPServer(s *http.Server) Option {
+	return func(f *FallbackServer) {
+		f.server = s
+	}
+}
+
+// WithTLS serves HTTPS, and HTTP/2 to clients that negotiate it, using
+// the given certificate settings. Certificates are reloaded when their
+// files change on disk, without restarting the server.
+func WithTLS(st ServerTLS) Option {
+	return func(f *FallbackServer) {
+		f.tls = &st
+	}
+}
+
+// WithH2C serves HTTP/2 to cleartext clients that use prior knowledge
+// or upgrade from HTTP/1.1, in addition to HTTP/1.1 itself.
+func WithH2C() Option {
+	return func(f *FallbackServer) {
+		f.h2c = true
+	}
+}
+
+// WithListener serves requests on the given listener,
+// instead of listening on the port given to NewServer.
+func WithListener(l net.Listener) Option {
+	return func(f *FallbackServer) {
+		f.listener = l
+	}
+}
+
+// WithLogger writes the server's log messages to the given Logger,
+// such as a *slog.Logger, instead of the default slog.Logger.
+func WithLogger(l Logger) Option {
+	return func(f *FallbackServer) {
+		f.logger = l
+	}
+}
+
+// WithAccessLog writes an entry to the given Logger, at the info level,
+// for each request proxied to a gRPC method, with the remote address,
+// request ID, method, status, latency and sizes of the request.
+// Configured with a JSON slog.Handler, it writes structured access logs.
+func WithAccessLog(l Logger) Option {
+	return func(f *FallbackServer) {
+		f.accessLog = l
+	}
+}
+
+// WithCORSPolicy sets the CORS headers of preflight and actual responses
+// according to the given policy, instead of DefaultCORSPolicy. WebSocket
+// requests are only accepted from the origins the policy allows.
+func WithCORSPolicy(p CORSPolicy) Option {
+	return func(f *FallbackServer) {
+		f.cors = &p
+	}
+}
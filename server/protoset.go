@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// filesSource is a DescriptorSource backed by a fixed set of files.
+type filesSource struct {
+	files *protoregistry.Files
+}
+
+func (s filesSource) FindService(name string) (protoreflect.ServiceDescriptor, error) {
+	return findService(s.files, name)
+}
+
+func (s filesSource) Services() ([]protoreflect.ServiceDescriptor, error) {
+	return listServices(s.files), nil
+}
+
+// LoadDescriptorSets creates a DescriptorSource from the given serialized
+// FileDescriptorSet files, such as those produced by protoc with the
+// --descriptor_set_out and --include_imports flags.
+//
+// Every import must be present in one of the sets, unless its descriptor
+// is linked into the binary, as is the case for the well-known types.
+// A file included in multiple sets must be identical in each of them,
+// and no symbol may be defined more than once.
+func LoadDescriptorSets(paths ...string) (DescriptorSource, error) {
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	origin := make(map[string]string)
+
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading descriptor set: %v", err)
+		}
+
+		set := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(b, set); err != nil {
+			return nil, fmt.Errorf("error parsing descriptor set %s: %v", path, err)
+		}
+
+		for _, fd := range set.GetFile() {
+			name := fd.GetName()
+			if prev, ok := files[name]; ok && !proto.Equal(prev, fd) {
+				return nil, fmt.Errorf("conflicting definitions of %s in descriptor sets %s and %s", name, origin[name], path)
+			}
+			files[name] = fd
+			origin[name] = path
+		}
+	}
+
+	// fill in imports from the descriptors linked into the binary,
+	// and report anything that cannot be found
+	var missing []string
+	reported := make(map[string]bool)
+	for queue := missingDeps(files); len(queue) > 0; queue = queue[1:] {
+		dep := queue[0]
+		if _, ok := files[dep]; ok || reported[dep] {
+			continue
+		}
+
+		fd, err := protoregistry.GlobalFiles.FindFileByPath(dep)
+		if err != nil {
+			reported[dep] = true
+			missing = append(missing, fmt.Sprintf("%s (imported by %s)", dep, importers(files, dep)))
+			continue
+		}
+		files[dep] = protodesc.ToFileDescriptorProto(fd)
+		queue = append(queue, files[dep].GetDependency()...)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("descriptor sets are missing imports, regenerate them with --include_imports: %s", strings.Join(missing, ", "))
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range files {
+		set.File = append(set.File, fd)
+	}
+
+	reg, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor sets: %v", err)
+	}
+
+	return filesSource{files: reg}, nil
+}
+
+// importers lists the files that import the given dependency.
+func importers(files map[string]*descriptorpb.FileDescriptorProto, dep string) string {
+	var names []string
+	for name, fd := range files {
+		for _, d := range fd.GetDependency() {
+			if d == dep {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	_ "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// writeDescriptorSet serializes the given files into a FileDescriptorSet
+// file in a temporary directory and returns its path.
+func writeDescriptorSet(t *testing.T, name string, files ...*descriptorpb.FileDescriptorProto) string {
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: files})
+	if err != nil {
+		t.Fatalf("error serializing descriptor set: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatalf("error writing descriptor set: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadDescriptorSets(t *testing.T) {
+	health := protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto)
+
+	// a service that depends on a file that was not included
+	orphan := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test/orphan.proto"),
+		Package:    proto.String("test"),
+		Dependency: []string{"test/missing.proto"},
+		Syntax:     proto.String("proto3"),
+	}
+
+	// a service that depends on a well-known type
+	wkt := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test/wkt.proto"),
+		Package:    proto.String("test"),
+		Dependency: []string{"google/protobuf/empty.proto"},
+		Syntax:     proto.String("proto3"),
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Pinger"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Ping"),
+				InputType:  proto.String(".google.protobuf.Empty"),
+				OutputType: proto.String(".google.protobuf.Empty"),
+			}},
+		}},
+	}
+
+	// a different definition of the health proto
+	modified := proto.Clone(health).(*descriptorpb.FileDescriptorProto)
+	modified.Package = proto.String("other")
+
+	// the same symbols defined in a different file
+	dupe := proto.Clone(health).(*descriptorpb.FileDescriptorProto)
+	dupe.Name = proto.String("test/dupe.proto")
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pb")
+	ioutil.WriteFile(invalid, []byte("not a descriptor set"), 0644)
+
+	tests := []struct {
+		name        string
+		paths       []string
+		wantService string
+		wantErr     string
+	}{
+		{name: "basic", paths: []string{writeDescriptorSet(t, "health.pb", health)}, wantService: "grpc.health.v1.Health"},
+		{name: "well-known import", paths: []string{writeDescriptorSet(t, "wkt.pb", wkt)}, wantService: "test.Pinger"},
+		{name: "same file in multiple sets", paths: []string{writeDescriptorSet(t, "a.pb", health), writeDescriptorSet(t, "b.pb", health)}, wantService: "grpc.health.v1.Health"},
+		{name: "missing import", paths: []string{writeDescriptorSet(t, "orphan.pb", orphan)}, wantErr: "test/missing.proto (imported by test/orphan.proto)"},
+		{name: "conflicting file", paths: []string{writeDescriptorSet(t, "a.pb", health), writeDescriptorSet(t, "b.pb", modified)}, wantErr: "conflicting definitions of grpc/health/v1/health.proto"},
+		{name: "duplicate symbol", paths: []string{writeDescriptorSet(t, "dupe.pb", health, dupe)}, wantErr: "invalid descriptor sets"},
+		{name: "missing file", paths: []string{filepath.Join(t.TempDir(), "nope.pb")}, wantErr: "error reading descriptor set"},
+		{name: "invalid file", paths: []string{invalid}, wantErr: "error parsing descriptor set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := LoadDescriptorSets(tt.paths...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadDescriptorSets() %s error: got = %v, want = %s", tt.name, err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("LoadDescriptorSets() %s unexpected error = %v", tt.name, err)
+				return
+			}
+
+			if _, err := src.FindService(tt.wantService); err != nil {
+				t.Errorf("LoadDescriptorSets() %s: FindService(%s) error = %v", tt.name, tt.wantService, err)
+			}
+
+			if _, err := src.FindService("foo.Bar"); status.Code(err) != codes.NotFound {
+				t.Errorf("LoadDescriptorSets() %s: FindService(foo.Bar) got = %v, want = NotFound", tt.name, err)
+			}
+		})
+	}
+}
+
+func Test_multiSource_FindService(t *testing.T) {
+	unavailable := &testSource{err: status.Error(codes.Unavailable, "test")}
+	notFound := &testSource{err: status.Error(codes.NotFound, "test")}
+
+	tests := []struct {
+		name     string
+		sources  multiSource
+		wantCode codes.Code
+	}{
+		{name: "first found", sources: multiSource{&testSource{}, unavailable}},
+		{name: "second found", sources: multiSource{notFound, &testSource{}}},
+		{name: "all not found", sources: multiSource{notFound, notFound}, wantCode: codes.NotFound},
+		{name: "lookup failure", sources: multiSource{notFound, unavailable}, wantCode: codes.Unavailable},
+		{name: "empty", wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.sources.FindService("grpc.health.v1.Health")
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("multiSource.FindService() %s: got = %v, want = %v", tt.name, code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_preStart_descriptors(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantNil bool
+		wantLen int
+	}{
+		{name: "none", wantNil: true},
+		{name: "single source", opts: []Option{WithDescriptorSource(&testSource{})}},
+		{name: "reflection", opts: []Option{WithReflection(0)}},
+		{name: "combined", opts: []Option{WithDescriptorSource(&testSource{}), WithReflection(0)}, wantLen: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewServer("0", "localhost:1234", tt.opts...)
+			if err := f.preStart(); err != nil {
+				t.Fatalf("preStart() %s: unexpected error: %v", tt.name, err)
+			}
+
+			if (f.descriptors == nil) != tt.wantNil {
+				t.Errorf("preStart() %s descriptors: got = %v, wantNil = %v", tt.name, f.descriptors, tt.wantNil)
+			}
+
+			if m, ok := f.descriptors.(multiSource); ok != (tt.wantLen > 0) || len(m) != tt.wantLen {
+				t.Errorf("preStart() %s: got = %T, want %d combined sources", tt.name, f.descriptors, tt.wantLen)
+			}
+		})
+	}
+}
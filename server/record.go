@@ -0,0 +1,237 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+
+	// maxRequestIDLength bounds the length of request IDs
+	// supplied by clients, which are otherwise replaced
+	maxRequestIDLength = 128
+)
+
+// requestRecord is the outcome of a request for a gRPC method, as recorded
+// by its handler, for the metrics and access log of the server.
+type requestRecord struct {
+	id              string
+	service, method string
+	known           bool
+	code            codes.Code
+	coded           bool
+
+	status           int
+	reqSize, resSize int64
+	latency          time.Duration
+}
+
+type recordKey struct{}
+
+// withRecord is middleware recording each request for a gRPC method, once it
+// has been handled, in the server's metrics and access log. Requests have the
+// ID of their X-Request-Id header, or a random one, which is also set on the
+// response. Other requests, such as those of the health endpoints, are not
+// recorded.
+func (f *FallbackServer) withRecord(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &requestRecord{id: requestID(r)}
+		w.Header().Set(requestIDHeader, rec.id)
+
+		sw := &statusWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), recordKey{}, rec))
+		body := &countingReader{r: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+
+		next.ServeHTTP(sw, r)
+		if rec.method == "" {
+			return
+		}
+
+		rec.finish(sw, body.n, time.Since(start))
+		if f.metrics != nil {
+			f.metrics.observe(rec)
+		}
+		if f.accessLog != nil {
+			f.logAccess(r, rec)
+		}
+	})
+}
+
+// finish completes the record once the request has been handled. Requests
+// not given a gRPC status by their handler have an OK status, or UNKNOWN if
+// the HTTP status is an error.
+func (rec *requestRecord) finish(w *statusWriter, reqSize int64, latency time.Duration) {
+	rec.status = w.status
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.coded && rec.status >= http.StatusBadRequest {
+		rec.code = codes.Unknown
+	}
+
+	rec.reqSize, rec.resSize = reqSize, w.size
+	rec.latency = latency
+}
+
+// logAccess writes the access log entry of the request.
+func (f *FallbackServer) logAccess(r *http.Request, rec *requestRecord) {
+	f.accessLog.Info("Handled request",
+		"remote_addr", r.RemoteAddr,
+		"request_id", rec.id,
+		"service", rec.service,
+		"method", rec.method,
+		"code", rec.code.String(),
+		"status", rec.status,
+		"latency", rec.latency,
+		"request_size", rec.reqSize,
+		"response_size", rec.resSize)
+}
+
+// requestID returns the ID of the request given by the client, if it is
+// printable and not too long, or a random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= maxRequestIDLength && printable(id) {
+		return id
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// printable reports whether s only has printable ASCII characters.
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordMethod records the gRPC method the request is proxied to, and
+// whether the server knows it not to be served.
+func (f *FallbackServer) recordMethod(r *http.Request, method string) {
+	if rec, ok := r.Context().Value(recordKey{}).(*requestRecord); ok {
+		rec.service, rec.method = splitMethod(method)
+		rec.known = f.knownMethod(rec.service, rec.method)
+	}
+}
+
+// knownMethod reports whether the given method may be served, as far as
+// the server knows: its service is routed to a backend, and the method is
+// resolved by the descriptors of the server, if any are configured. Without
+// descriptors, any name given by the client may be served, until a backend
+// answers that it is unimplemented.
+func (f *FallbackServer) knownMethod(service, method string) bool {
+	if rc, ok := f.cc.(*routedConnection); ok {
+		if _, err := rc.route(buildMethod(service, method)); err != nil {
+			return false
+		}
+	}
+	if f.descriptors == nil {
+		return true
+	}
+
+	_, err := f.findMethod(service, method)
+	return status.Code(err) != codes.NotFound
+}
+
+// recordCode records the gRPC status code the request ended with,
+// for its record and span.
+func recordCode(r *http.Request, code codes.Code) {
+	if rec, ok := r.Context().Value(recordKey{}).(*requestRecord); ok {
+		rec.code, rec.coded = code, true
+	}
+	if rs, ok := r.Context().Value(spanKey{}).(*requestSpan); ok {
+		rs.setCode(code)
+	}
+}
+
+// statusWriter is an http.ResponseWriter recording the status and size of
+// the response. It flushes and hijacks the underlying writer, so streaming
+// and WebSockets keep working.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	flush(w.ResponseWriter)
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
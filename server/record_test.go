@@ -0,0 +1,174 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestFallbackServer_accessLog(t *testing.T) {
+	var buf bytes.Buffer
+	f := &FallbackServer{
+		cc:        testBackend(t, false),
+		accessLog: slog.New(slog.NewJSONHandler(&buf, nil)),
+	}
+
+	r := mux.NewRouter()
+	r.Use(f.withRecord)
+	r.HandleFunc(healthzPath, f.healthz)
+	r.HandleFunc(fallbackPath, f.handler).Headers("Content-Type", protoType)
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	body, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "error"})
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/$rpc/grpc.health.v1.Health/Check", bytes.NewReader(body))
+	req.Header.Set("Content-Type", protoType)
+	req.Header.Set(requestIDHeader, "req-1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("accessLog(): %v", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if got := res.Header.Get(requestIDHeader); got != "req-1" {
+		t.Errorf("accessLog() response request ID: got = %s, want = req-1", got)
+	}
+
+	// only requests for gRPC methods are logged
+	if res, err := http.Get(s.URL + healthzPath); err == nil {
+		res.Body.Close()
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("accessLog(): got %d entries, want = 1:\n%s", len(lines), buf.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("accessLog(): invalid entry %q: %v", lines[0], err)
+	}
+	for k, want := range map[string]interface{}{
+		"level":        "INFO",
+		"request_id":   "req-1",
+		"service":      "grpc.health.v1.Health",
+		"method":       "Check",
+		"code":         "NotFound",
+		"status":       float64(http.StatusNotFound),
+		"request_size": float64(len(body)),
+	} {
+		if got[k] != want {
+			t.Errorf("accessLog() %s: got = %v, want = %v", k, got[k], want)
+		}
+	}
+	for _, k := range []string{"remote_addr", "latency", "response_size"} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("accessLog(): missing %s in %s", k, lines[0])
+		}
+	}
+}
+
+func Test_requestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "given", header: "abc-123", want: "abc-123"},
+		{name: "missing"},
+		{name: "unprintable", header: "abc\x01"},
+		{name: "too long", header: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/test", nil)
+		if tt.header != "" {
+			r.Header.Set(requestIDHeader, tt.header)
+		}
+
+		got := requestID(r)
+		if tt.want != "" && got != tt.want {
+			t.Errorf("requestID() %s: got = %s, want = %s", tt.name, got, tt.want)
+		}
+		if tt.want == "" && (len(got) != 32 || got == tt.header) {
+			t.Errorf("requestID() %s: got = %s, want random ID", tt.name, got)
+		}
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &statusWriter{ResponseWriter: rec}
+
+	w.Write([]byte("hello"))
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(", world"))
+	w.Flush()
+
+	if w.status != http.StatusOK {
+		t.Errorf("statusWriter status: got = %d, want = %d", w.status, http.StatusOK)
+	}
+	if w.size != 12 {
+		t.Errorf("statusWriter size: got = %d, want = 12", w.size)
+	}
+	if !rec.Flushed {
+		t.Errorf("statusWriter.Flush(): got flushed = false, want = true")
+	}
+	if _, _, err := w.Hijack(); err == nil {
+		t.Errorf("statusWriter.Hijack() unsupported: got err = nil, want error")
+	}
+}
+
+func TestFallbackServer_knownMethod(t *testing.T) {
+	routed := &routedConnection{routes: []Route{
+		{Service: "a.B", Backend: "localhost:2000"},
+		{Service: "c.*", Backend: "localhost:3000"},
+	}}
+	routed.conns = []connection{&testConnection{}, &testConnection{}}
+
+	tests := []struct {
+		name            string
+		f               *FallbackServer
+		service, method string
+		want            bool
+	}{
+		{name: "no descriptors", f: &FallbackServer{cc: &testConnection{}}, service: "x.Y", method: "Z", want: true},
+		{name: "resolved", f: &FallbackServer{cc: &testConnection{}, descriptors: &testSource{}}, service: "grpc.health.v1.Health", method: "Check", want: true},
+		{name: "unresolved method", f: &FallbackServer{cc: &testConnection{}, descriptors: &testSource{}}, service: "grpc.health.v1.Health", method: "Unknown", want: false},
+		{name: "unresolved service", f: &FallbackServer{cc: &testConnection{}, descriptors: &testSource{}}, service: "x.Y", method: "Z", want: false},
+		{name: "unavailable descriptors", f: &FallbackServer{cc: &testConnection{}, descriptors: &testSource{err: status.Error(codes.Unavailable, "down")}}, service: "x.Y", method: "Z", want: true},
+		{name: "routed", f: &FallbackServer{cc: routed}, service: "a.B", method: "C", want: true},
+		{name: "routed by pattern", f: &FallbackServer{cc: routed}, service: "c.D", method: "E", want: true},
+		{name: "not routed", f: &FallbackServer{cc: routed}, service: "x.Y", method: "Z", want: false},
+		{name: "routed unresolved", f: &FallbackServer{cc: routed, descriptors: &testSource{}}, service: "a.B", method: "C", want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.f.knownMethod(tt.service, tt.method); got != tt.want {
+			t.Errorf("FallbackServer.knownMethod() %s: got = %v, want = %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+const (
+	// defaultReflectionTTL is how long descriptors retrieved via
+	// server reflection are cached when no TTL is configured.
+	defaultReflectionTTL = 5 * time.Minute
+
+	// reflectionTimeout bounds the time spent resolving a single service.
+	reflectionTimeout = 10 * time.Second
+)
+
+// reflectionMethods are the server reflection RPCs, in order of preference.
+// The v1 and v1alpha messages are identical on the wire, so the v1alpha
+// types are used for both.
+var reflectionMethods = []string{
+	"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+}
+
+// reflectionSource is a DescriptorSource that queries the gRPC server
+// reflection API of the backend. Resolved services, and services the
+// backend reported as unknown, are cached until their TTL expires. Other
+// errors, such as the backend being unavailable, are not cached, so that
+// services are resolved as soon as the backend recovers.
+type reflectionSource struct {
+	cc  connection
+	ttl time.Duration
+
+	mu     sync.Mutex
+	method string
+	cache  map[string]reflectionEntry
+}
+
+type reflectionEntry struct {
+	sd      protoreflect.ServiceDescriptor
+	err     error
+	expires time.Time
+}
+
+func newReflectionSource(cc connection, ttl time.Duration) *reflectionSource {
+	if ttl <= 0 {
+		ttl = defaultReflectionTTL
+	}
+
+	return &reflectionSource{
+		cc:    cc,
+		ttl:   ttl,
+		cache: make(map[string]reflectionEntry),
+	}
+}
+
+func (s *reflectionSource) FindService(name string) (protoreflect.ServiceDescriptor, error) {
+	s.mu.Lock()
+	e, ok := s.cache[name]
+	s.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.sd, e.err
+	}
+
+	sd, err := s.resolve(name)
+	if !answered(err) {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.cache[name] = reflectionEntry{sd: sd, err: err, expires: time.Now().Add(s.ttl)}
+	s.mu.Unlock()
+
+	return sd, err
+}
+
+// answered reports whether the error of a lookup is the backend's answer,
+// rather than a failure to get one.
+func answered(err error) bool {
+	return err == nil || status.Code(err) == codes.NotFound
+}
+
+// Refresh drops all cached service descriptors.
+func (s *reflectionSource) Refresh() {
+	s.mu.Lock()
+	s.cache = make(map[string]reflectionEntry)
+	s.mu.Unlock()
+}
+
+// Services lists the services of the backend, resolving each of them.
+func (s *reflectionSource) Services() ([]protoreflect.ServiceDescriptor, error) {
+	var names []string
+	err := s.call(func(method string) error {
+		var err error
+		names, err = s.list(method)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var services []protoreflect.ServiceDescriptor
+	for _, name := range names {
+		sd, err := s.FindService(name)
+		if err != nil {
+			return services, err
+		}
+		services = append(services, sd)
+	}
+
+	return services, nil
+}
+
+// resolve retrieves the named service's descriptor from the backend.
+func (s *reflectionSource) resolve(name string) (protoreflect.ServiceDescriptor, error) {
+	var files *protoregistry.Files
+	err := s.call(func(method string) error {
+		var err error
+		files, err = s.fetch(method, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return findService(files, name)
+}
+
+// call invokes fn with each version of the reflection API,
+// until one is implemented by the backend.
+func (s *reflectionSource) call(fn func(method string) error) error {
+	s.mu.Lock()
+	methods := reflectionMethods
+	if s.method != "" {
+		methods = []string{s.method}
+	}
+	s.mu.Unlock()
+
+	err := status.Error(codes.Unimplemented, "backend does not support server reflection")
+	for _, m := range methods {
+		err = fn(m)
+		if status.Code(err) == codes.Unimplemented {
+			continue
+		}
+
+		// remember which version of the API worked
+		if answered(err) {
+			s.mu.Lock()
+			s.method = m
+			s.mu.Unlock()
+		}
+
+		return err
+	}
+
+	return err
+}
+
+// list retrieves the names of the services the backend serves.
+func (s *reflectionSource) list(method string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reflectionTimeout)
+	defer cancel()
+
+	stream, err := s.cc.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	req := &rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"}}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+
+	res := &rpb.ServerReflectionResponse{}
+	if err := stream.RecvMsg(res); err != nil {
+		return nil, err
+	}
+
+	switch r := res.GetMessageResponse().(type) {
+	case *rpb.ServerReflectionResponse_ErrorResponse:
+		return nil, status.Error(codes.Code(r.ErrorResponse.GetErrorCode()), r.ErrorResponse.GetErrorMessage())
+	case *rpb.ServerReflectionResponse_ListServicesResponse:
+		var names []string
+		for _, svc := range r.ListServicesResponse.GetService() {
+			names = append(names, svc.GetName())
+		}
+		return names, nil
+	}
+
+	return nil, status.Errorf(codes.Internal, "unexpected server reflection response %T", res.GetMessageResponse())
+}
+
+// fetch downloads the file defining the given symbol, along with all of
+// its transitive dependencies, over a single reflection stream.
+func (s *reflectionSource) fetch(method, symbol string) (*protoregistry.Files, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reflectionTimeout)
+	defer cancel()
+
+	stream, err := s.cc.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	err = reflectionRequest(stream, &rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	}, files)
+	if err != nil {
+		return nil, err
+	}
+
+	// request any dependencies the server did not already send
+	for pending := missingDeps(files); len(pending) > 0; pending = missingDeps(files) {
+		for _, dep := range pending {
+			err := reflectionRequest(stream, &rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+			}, files)
+
+			if _, ok := files[dep]; ok {
+				continue
+			}
+
+			// fallback to the descriptors linked into the binary,
+			// which typically include the well-known types
+			fd, gErr := protoregistry.GlobalFiles.FindFileByPath(dep)
+			if gErr != nil {
+				if err == nil {
+					err = status.Errorf(codes.NotFound, "backend did not return file %s", dep)
+				}
+				return nil, status.Errorf(codes.FailedPrecondition, "error resolving dependency %s of %s: %v", dep, symbol, err)
+			}
+			files[dep] = protodesc.ToFileDescriptorProto(fd)
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range files {
+		set.File = append(set.File, fd)
+	}
+
+	reg, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid descriptors for %s: %v", symbol, err)
+	}
+
+	return reg, nil
+}
+
+// reflectionRequest sends a single request on the reflection stream and
+// adds the file descriptors in the response to the given set of files.
+func reflectionRequest(stream grpc.ClientStream, req *rpb.ServerReflectionRequest, files map[string]*descriptorpb.FileDescriptorProto) error {
+	if err := stream.SendMsg(req); err != nil {
+		return err
+	}
+
+	res := &rpb.ServerReflectionResponse{}
+	if err := stream.RecvMsg(res); err != nil {
+		return err
+	}
+
+	switch r := res.GetMessageResponse().(type) {
+	case *rpb.ServerReflectionResponse_ErrorResponse:
+		return status.Error(codes.Code(r.ErrorResponse.GetErrorCode()), r.ErrorResponse.GetErrorMessage())
+	case *rpb.ServerReflectionResponse_FileDescriptorResponse:
+		for _, b := range r.FileDescriptorResponse.GetFileDescriptorProto() {
+			fd := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fd); err != nil {
+				return status.Errorf(codes.Internal, "invalid file descriptor from backend: %v", err)
+			}
+			files[fd.GetName()] = fd
+		}
+		return nil
+	}
+
+	return status.Errorf(codes.Internal, "unexpected server reflection response %T", res.GetMessageResponse())
+}
+
+// missingDeps lists the dependencies of the given files that are
+// not themselves part of the set.
+func missingDeps(files map[string]*descriptorpb.FileDescriptorProto) []string {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, fd := range files {
+		for _, dep := range fd.GetDependency() {
+			if _, ok := files[dep]; !ok && !seen[dep] {
+				seen[dep] = true
+				missing = append(missing, dep)
+			}
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func Test_reflectionSource_FindService(t *testing.T) {
+	tests := []struct {
+		name           string
+		service        string
+		withReflection bool
+		wantMethods    []string
+		wantCode       codes.Code
+	}{
+		{name: "basic", service: "grpc.health.v1.Health", withReflection: true, wantMethods: []string{"Check", "Watch"}},
+		{name: "unknown service", service: "foo.Bar", withReflection: true, wantCode: codes.NotFound},
+		{name: "reflection unsupported", service: "grpc.health.v1.Health", wantCode: codes.Unimplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newReflectionSource(testBackend(t, tt.withReflection), 0)
+			got, err := s.FindService(tt.service)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("reflectionSource.FindService() %s code: got = %v (%v), want = %v", tt.name, code, err, tt.wantCode)
+				return
+			}
+
+			if err != nil {
+				return
+			}
+
+			for _, m := range tt.wantMethods {
+				if got.Methods().ByName(protoreflect.Name(m)) == nil {
+					t.Errorf("reflectionSource.FindService() %s: missing method %s", tt.name, m)
+				}
+			}
+		})
+	}
+}
+
+func Test_reflectionSource_cache(t *testing.T) {
+	s := newReflectionSource(testBackend(t, true), time.Hour)
+
+	first, err := s.FindService("grpc.health.v1.Health")
+	if err != nil {
+		t.Fatalf("reflectionSource.FindService() error = %v", err)
+	}
+
+	if s.method == "" {
+		t.Errorf("reflectionSource.FindService() did not remember the reflection method")
+	}
+
+	if second, _ := s.FindService("grpc.health.v1.Health"); second != first {
+		t.Errorf("reflectionSource.FindService() did not use the cached descriptor")
+	}
+
+	s.Refresh()
+	if len(s.cache) != 0 {
+		t.Errorf("reflectionSource.Refresh() got = %d cached entries, want = 0", len(s.cache))
+	}
+
+	if third, err := s.FindService("grpc.health.v1.Health"); err != nil || third == first {
+		t.Errorf("reflectionSource.FindService() after Refresh: got = %v, %v, want a new descriptor", third, err)
+	}
+}
+
+// outageConnection is a connection that is unavailable while down.
+type outageConnection struct {
+	connection
+
+	mu    sync.Mutex
+	down  bool
+	calls int
+}
+
+func (c *outageConnection) setDown(down bool) {
+	c.mu.Lock()
+	c.down = down
+	c.mu.Unlock()
+}
+
+func (c *outageConnection) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	c.mu.Lock()
+	c.calls++
+	down := c.down
+	c.mu.Unlock()
+	if down {
+		return nil, status.Error(codes.Unavailable, "backend unavailable")
+	}
+
+	return c.connection.NewStream(ctx, desc, method, opts...)
+}
+
+func Test_reflectionSource_outage(t *testing.T) {
+	cc := &outageConnection{connection: testBackend(t, true), down: true}
+	s := newReflectionSource(cc, time.Hour)
+
+	if _, err := s.FindService("grpc.health.v1.Health"); status.Code(err) != codes.Unavailable {
+		t.Fatalf("reflectionSource.FindService() during outage: got = %v, want = %v", err, codes.Unavailable)
+	}
+	if s.method != "" {
+		t.Errorf("reflectionSource.FindService() during outage: got method = %s, want none remembered", s.method)
+	}
+
+	// the backend's recovery is picked up without waiting for the TTL
+	cc.setDown(false)
+	if _, err := s.FindService("grpc.health.v1.Health"); err != nil {
+		t.Errorf("reflectionSource.FindService() after outage: got = %v, want = nil", err)
+	}
+
+	// unknown services are still cached
+	if _, err := s.FindService("foo.Bar"); status.Code(err) != codes.NotFound {
+		t.Fatalf("reflectionSource.FindService() unknown: got = %v, want = %v", err, codes.NotFound)
+	}
+	calls := cc.calls
+	if _, err := s.FindService("foo.Bar"); status.Code(err) != codes.NotFound || cc.calls != calls {
+		t.Errorf("reflectionSource.FindService() unknown again: got = %v after %d calls, want = %v from cache", err, cc.calls-calls, codes.NotFound)
+	}
+}
+
+func Test_reflectionSource_Services(t *testing.T) {
+	tests := []struct {
+		name           string
+		withReflection bool
+		want           []string
+		wantCode       codes.Code
+	}{
+		{
+			name:           "basic",
+			withReflection: true,
+			want:           []string{"grpc.health.v1.Health", "grpc.reflection.v1alpha.ServerReflection", "grpc.testing.TestService"},
+		},
+		{name: "reflection unsupported", wantCode: codes.Unimplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newReflectionSource(testBackend(t, tt.withReflection), 0)
+			got, err := s.Services()
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("reflectionSource.Services() %s code: got = %v (%v), want = %v", tt.name, code, err, tt.wantCode)
+				return
+			}
+
+			names := make(map[string]bool)
+			for _, sd := range got {
+				names[string(sd.FullName())] = true
+			}
+			for _, want := range tt.want {
+				if !names[want] {
+					t.Errorf("reflectionSource.Services() %s: missing service %s", tt.name, want)
+				}
+			}
+		})
+	}
+}
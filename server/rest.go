@@ -0,0 +1,511 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// restRoute is an HTTP route derived from a google.api.http annotation.
+type restRoute struct {
+	md protoreflect.MethodDescriptor
+
+	// HTTP method and mux path template of the route
+	method string
+	path   string
+
+	// vars maps the mux variables of the path
+	// to the fields of the request they bind
+	vars map[string]string
+
+	// body and responseBody select the fields of the request and
+	// response that make up the HTTP request and response bodies
+	body         string
+	responseBody string
+
+	// whether the path ends in a custom verb
+	verb bool
+}
+
+// registerREST adds the routes of every google.api.http annotation in the
+// descriptors of the proxied services to the router. Services are listed
+// once, so only those known when the server starts are routed.
+func (f *FallbackServer) registerREST(r *mux.Router) {
+	var src DescriptorSource = globalSource{}
+	if f.descriptors != nil {
+		src = f.descriptors
+	}
+
+	l, ok := src.(serviceLister)
+	if !ok {
+		f.log().Warn("Unable to register REST routes: descriptor source cannot list services")
+		return
+	}
+
+	services, err := l.Services()
+	if err != nil {
+		f.log().Error("Error listing services for REST routes", "error", err)
+	}
+
+	routes := restRoutes(services, f.log())
+	var handlers []*mux.Route
+	for _, rt := range routes {
+		handlers = append(handlers, r.HandleFunc(rt.path, f.restHandler(rt)).
+			Methods(rt.method))
+	}
+	for _, rt := range routes {
+		r.HandleFunc(rt.path, f.restOptions(handlers)).
+			Methods(http.MethodOptions)
+	}
+	f.log().Info("Registered REST routes", "routes", len(routes))
+}
+
+// restOptions is a handler for the OPTIONS call that precedes CORS-enabled
+// calls to REST routes. The requested method is allowed, in addition to
+// those of the CORS policy, if one of the given routes serves it.
+func (f *FallbackServer) restOptions(routes []*mux.Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger(r).Debug("Incoming OPTIONS for request", "uri", r.RequestURI)
+
+		p := *f.corsPolicy()
+		if m := r.Header.Get("Access-Control-Request-Method"); m != "" && !contains(p.AllowedMethods, m) {
+			req := r.Clone(r.Context())
+			req.Method = m
+			for _, route := range routes {
+				if route.Match(req, &mux.RouteMatch{}) {
+					p.AllowedMethods = append(append([]string{}, p.AllowedMethods...), m)
+					break
+				}
+			}
+		}
+
+		p.preflight(w, r)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// restRoutes derives the routes of the given services' methods. Routes
+// with custom verbs come first, so that they take precedence over routes
+// whose last variable would otherwise match the verb too. Invalid routes
+// are skipped, logging why to the given Logger.
+func restRoutes(services []protoreflect.ServiceDescriptor, l Logger) []*restRoute {
+	var routes []*restRoute
+	for _, sd := range services {
+		for i := 0; i < sd.Methods().Len(); i++ {
+			md := sd.Methods().Get(i)
+
+			// request bodies of client-streaming methods cannot
+			// be mapped onto a single message
+			if md.IsStreamingClient() {
+				continue
+			}
+
+			rule, ok := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+			if !ok || rule == nil {
+				continue
+			}
+
+			for _, b := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+				rt, err := newRESTRoute(md, b)
+				if err != nil {
+					l.Warn("Skipping REST route", "method", md.FullName(), "error", err)
+					continue
+				}
+				routes = append(routes, rt)
+			}
+		}
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].verb && !routes[j].verb
+	})
+
+	return routes
+}
+
+// newRESTRoute creates the route for a single HTTP binding of the method.
+func newRESTRoute(md protoreflect.MethodDescriptor, rule *annotations.HttpRule) (*restRoute, error) {
+	rt := &restRoute{
+		md:           md,
+		vars:         make(map[string]string),
+		body:         rule.GetBody(),
+		responseBody: rule.GetResponseBody(),
+	}
+
+	var tpl string
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		rt.method, tpl = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		rt.method, tpl = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		rt.method, tpl = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		rt.method, tpl = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		rt.method, tpl = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		rt.method, tpl = p.Custom.GetKind(), p.Custom.GetPath()
+	default:
+		return nil, fmt.Errorf("missing path pattern")
+	}
+
+	if rt.body != "" && rt.body != "*" {
+		if _, err := findFieldPath(md.Input(), rt.body); err != nil {
+			return nil, err
+		}
+	}
+	if rt.responseBody != "" && rt.responseBody != "*" {
+		if _, err := findFieldPath(md.Output(), rt.responseBody); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if rt.path, err = rt.parseTemplate(tpl); err != nil {
+		return nil, fmt.Errorf("invalid path template %q: %v", tpl, err)
+	}
+
+	return rt, nil
+}
+
+// parseTemplate converts a google.api.http path template into a mux path
+// template, in which each variable is a mux variable matching its segments.
+func (rt *restRoute) parseTemplate(tpl string) (string, error) {
+	if !strings.HasPrefix(tpl, "/") {
+		return "", fmt.Errorf("must start with /")
+	}
+
+	// a custom verb follows the last segment, and
+	// is matched like any other literal
+	rt.verb = strings.LastIndex(tpl, ":") > strings.LastIndexAny(tpl, "/}")
+
+	var sb strings.Builder
+	wildcards := 0
+	for i := 0; i < len(tpl); {
+		switch {
+		case tpl[i] == '{':
+			end := strings.IndexByte(tpl[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable")
+			}
+
+			field, segs := tpl[i+1:i+end], "*"
+			if eq := strings.IndexByte(field, '='); eq >= 0 {
+				field, segs = field[:eq], field[eq+1:]
+			}
+			if _, err := findFieldPath(rt.md.Input(), field); err != nil {
+				return "", err
+			}
+
+			name := fmt.Sprintf("v%d", len(rt.vars))
+			rt.vars[name] = field
+			fmt.Fprintf(&sb, "{%s:%s}", name, segmentsPattern(segs))
+			i += end + 1
+		case tpl[i] == '*':
+			// match anonymous wildcards with unused variables
+			seg := "*"
+			if strings.HasPrefix(tpl[i:], "**") {
+				seg = "**"
+			}
+			fmt.Fprintf(&sb, "{w%d:%s}", wildcards, segmentsPattern(seg))
+			wildcards++
+			i += len(seg)
+		default:
+			sb.WriteByte(tpl[i])
+			i++
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// segmentsPattern converts the segments of a path template
+// into a regular expression matching them.
+func segmentsPattern(segs string) string {
+	parts := strings.Split(segs, "/")
+	for i, p := range parts {
+		switch p {
+		case "*":
+			parts[i] = "[^/]+"
+		case "**":
+			parts[i] = ".+"
+		default:
+			parts[i] = regexp.QuoteMeta(p)
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// restHandler is the HTTP handler of a REST route. The request message is
+// built from the path variables, query parameters and body of the request,
+// and the response message is returned as proto3 JSON.
+func (f *FallbackServer) restHandler(rt *restRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger(r).Debug("Incoming REST request", "http_method", r.Method, "uri", r.RequestURI)
+
+		// allow the origins permitted by the CORS policy
+		f.corsPolicy().apply(w, r)
+		w.Header().Set("Content-Type", jsonType)
+
+		req, err := rt.request(r)
+		if err != nil {
+			writeJSONError(w, r, err)
+			return
+		}
+
+		// copy headers into out-going context metadata
+		m := buildMethod(string(rt.md.Parent().FullName()), string(rt.md.Name()))
+		ctx, cancel, err := f.requestContext(r, m)
+		if err != nil {
+			writeJSONError(w, r, err)
+			return
+		}
+		defer cancel()
+
+		if rt.md.IsStreamingServer() {
+			f.serverStream(ctx, w, r, m, req, &jsonFramer{md: rt.md})
+			return
+		}
+
+		var header, trailer metadata.MD
+		res := &bytes.Buffer{}
+		err = f.cc.Invoke(ctx, m, bytes.NewReader(req), res, grpc.Header(&header), grpc.Trailer(&trailer))
+		f.writeHeaderMetadata(w, header, trailer)
+		defer f.writeTrailerMetadata(w, trailer, false)
+		if err != nil {
+			writeJSONError(w, r, err)
+			return
+		}
+
+		b, err := rt.response(res.Bytes())
+		if err != nil {
+			writeJSONError(w, r, err)
+			return
+		}
+
+		w.Write(b)
+	}
+}
+
+// request builds the protobuf binary request message of the HTTP request.
+func (rt *restRoute) request(r *http.Request) ([]byte, error) {
+	msg := dynamicpb.NewMessage(rt.md.Input())
+
+	if rt.body != "" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "error reading request body: %v", err)
+		}
+
+		// wrap the body selected by a field in an object, so that
+		// it is parsed according to the type of the field
+		if rt.body != "*" && len(bytes.TrimSpace(body)) > 0 {
+			fields, _ := findFieldPath(rt.md.Input(), rt.body)
+			params := make(map[string]interface{})
+			setParam(params, fields, json.RawMessage(body))
+			body, _ = json.Marshal(params)
+		}
+
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := protojson.Unmarshal(body, msg); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid JSON request body: %v", err)
+			}
+		}
+	}
+
+	// gather the fields bound by the path and query parameters
+	bound := make(map[string][]string)
+	for name, field := range rt.vars {
+		bound[field] = []string{mux.Vars(r)[name]}
+	}
+	if rt.body != "*" {
+		for key, values := range r.URL.Query() {
+			if _, ok := bound[key]; !ok && key != rt.body {
+				bound[key] = values
+			}
+		}
+	}
+
+	params := make(map[string]interface{})
+	for field, values := range bound {
+		fields, err := findFieldPath(rt.md.Input(), field)
+		if err != nil {
+			// ignore unknown query parameters
+			continue
+		}
+
+		v, err := paramValue(fields[len(fields)-1], values)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value for %s: %v", field, err)
+		}
+		setParam(params, fields, v)
+	}
+
+	if len(params) > 0 {
+		b, _ := json.Marshal(params)
+		p := dynamicpb.NewMessage(rt.md.Input())
+		if err := protojson.Unmarshal(b, p); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid request parameters: %v", err)
+		}
+		proto.Merge(msg, p)
+	}
+
+	return proto.Marshal(msg)
+}
+
+// response encodes the protobuf binary response message, or the field
+// selected as the response body, as proto3 JSON.
+func (rt *restRoute) response(b []byte) ([]byte, error) {
+	if rt.responseBody == "" || rt.responseBody == "*" {
+		return encodeJSON(rt.md.Output(), b)
+	}
+
+	msg := dynamicpb.NewMessage(rt.md.Output())
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid response from backend: %v", err)
+	}
+
+	fields, _ := findFieldPath(rt.md.Output(), rt.responseBody)
+	fd := fields[len(fields)-1]
+	if fd.Message() != nil && !fd.IsList() && !fd.IsMap() {
+		b, err := protojson.Marshal(msg.Get(fd).Message().Interface())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error encoding JSON response: %v", err)
+		}
+		return b, nil
+	}
+
+	// encode the whole message, including
+	// defaults, and pick out the field
+	b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(msg)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error encoding JSON response: %v", err)
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, status.Errorf(codes.Internal, "error encoding JSON response: %v", err)
+	}
+
+	return obj[fd.JSONName()], nil
+}
+
+// findFieldPath resolves the fields along a dot-separated path of field
+// names, or JSON names, in the given message. Every field but the last
+// must be a singular message field.
+func findFieldPath(md protoreflect.MessageDescriptor, path string) ([]protoreflect.FieldDescriptor, error) {
+	var fields []protoreflect.FieldDescriptor
+	for i, name := range strings.Split(path, ".") {
+		if md == nil {
+			return nil, fmt.Errorf("field path %s traverses a non-message field", path)
+		}
+
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("unknown field %s in %s", name, md.FullName())
+		}
+		if i < len(strings.Split(path, "."))-1 && (fd.IsList() || fd.IsMap()) {
+			return nil, fmt.Errorf("field path %s traverses a repeated field", path)
+		}
+
+		fields = append(fields, fd)
+		md = fd.Message()
+	}
+
+	return fields, nil
+}
+
+// paramValue converts the string values of a path variable or query
+// parameter into the JSON value of the given field, leaving the parsing
+// of the value to protojson, which accepts strings for most types.
+func paramValue(fd protoreflect.FieldDescriptor, values []string) (interface{}, error) {
+	if fd.IsMap() {
+		return nil, fmt.Errorf("map fields cannot be set by parameters")
+	}
+
+	if !fd.IsList() {
+		if len(values) != 1 {
+			return nil, fmt.Errorf("got %d values for a singular field", len(values))
+		}
+		return scalarValue(fd, values[0])
+	}
+
+	list := make([]interface{}, 0, len(values))
+	for _, s := range values {
+		v, err := scalarValue(fd, s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+
+	return list, nil
+}
+
+// scalarValue converts a single string value into a JSON value. Booleans and
+// enum numbers are the only values protojson does not accept as strings.
+func scalarValue(fd protoreflect.FieldDescriptor, s string) (interface{}, error) {
+	switch {
+	case fd.Kind() == protoreflect.BoolKind,
+		fd.Message() != nil && fd.Message().FullName() == "google.protobuf.BoolValue":
+		return strconv.ParseBool(s)
+	case fd.Kind() == protoreflect.EnumKind:
+		if n, err := strconv.Atoi(s); err == nil {
+			return n, nil
+		}
+	}
+
+	return s, nil
+}
+
+// setParam sets the value at the given field path of a nested JSON object.
+func setParam(params map[string]interface{}, fields []protoreflect.FieldDescriptor, v interface{}) {
+	for _, fd := range fields[:len(fields)-1] {
+		name := string(fd.Name())
+		next, ok := params[name].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			params[name] = next
+		}
+		params = next
+	}
+
+	params[string(fields[len(fields)-1].Name())] = v
+}
@@ -0,0 +1,286 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	lrpb "google.golang.org/genproto/googleapis/longrunning"
+)
+
+// operationsMethod returns the descriptor of a method of the
+// google.longrunning.Operations service, which has HTTP annotations.
+func operationsMethod(name string) protoreflect.MethodDescriptor {
+	return lrpb.File_google_longrunning_operations_proto.Services().ByName("Operations").Methods().ByName(protoreflect.Name(name))
+}
+
+func Test_restRoute_parseTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		tpl      string
+		want     string
+		wantVars map[string]string
+		wantVerb bool
+		wantErr  bool
+	}{
+		{
+			name:     "variable",
+			tpl:      "/v1/{name}",
+			want:     "/v1/{v0:[^/]+}",
+			wantVars: map[string]string{"v0": "name"},
+		},
+		{
+			name:     "variable segments",
+			tpl:      "/v1/{name=operations/**}",
+			want:     "/v1/{v0:operations/.+}",
+			wantVars: map[string]string{"v0": "name"},
+		},
+		{
+			name:     "custom verb",
+			tpl:      "/v1/{name=operations/*}:cancel",
+			want:     "/v1/{v0:operations/[^/]+}:cancel",
+			wantVars: map[string]string{"v0": "name"},
+			wantVerb: true,
+		},
+		{
+			name:     "wildcards",
+			tpl:      "/v1/*/operations/**",
+			want:     "/v1/{w0:[^/]+}/operations/{w1:.+}",
+			wantVars: map[string]string{},
+		},
+		{
+			name:    "unknown field",
+			tpl:     "/v1/{unknown}",
+			wantErr: true,
+		},
+		{
+			name:    "relative",
+			tpl:     "v1/{name}",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated",
+			tpl:     "/v1/{name",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		rt := &restRoute{md: operationsMethod("GetOperation"), vars: make(map[string]string)}
+		got, err := rt.parseTemplate(tt.tpl)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTemplate() %s: got err = %v, wantErr = %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("parseTemplate() %s: got = %s, want = %s", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(rt.vars, tt.wantVars) {
+			t.Errorf("parseTemplate() %s vars: got = %v, want = %v", tt.name, rt.vars, tt.wantVars)
+		}
+		if rt.verb != tt.wantVerb {
+			t.Errorf("parseTemplate() %s verb: got = %v, want = %v", tt.name, rt.verb, tt.wantVerb)
+		}
+	}
+}
+
+func TestFallbackServer_restHandler(t *testing.T) {
+	op, _ := proto.Marshal(&lrpb.Operation{Name: "operations/abc", Done: true})
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		cc       *testConnection
+		wantReq  proto.Message
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "path variable",
+			method:   http.MethodGet,
+			target:   "/v1/operations/abc/def",
+			cc:       &testConnection{res: op},
+			wantReq:  &lrpb.GetOperationRequest{Name: "operations/abc/def"},
+			wantCode: http.StatusOK,
+			wantBody: `{"name":"operations/abc","done":true}`,
+		},
+		{
+			name:     "query parameters",
+			method:   http.MethodGet,
+			target:   "/v1/operations?filter=done&page_size=5&pageToken=t&unknown=1",
+			cc:       &testConnection{res: []byte{}},
+			wantReq:  &lrpb.ListOperationsRequest{Name: "operations", Filter: "done", PageSize: 5, PageToken: "t"},
+			wantCode: http.StatusOK,
+			wantBody: `{}`,
+		},
+		{
+			name:     "custom verb with body",
+			method:   http.MethodPost,
+			target:   "/v1/operations/abc:cancel",
+			body:     `{}`,
+			cc:       &testConnection{res: []byte{}},
+			wantReq:  &lrpb.CancelOperationRequest{Name: "operations/abc"},
+			wantCode: http.StatusOK,
+			wantBody: `{}`,
+		},
+		{
+			name:     "delete",
+			method:   http.MethodDelete,
+			target:   "/v1/operations/abc",
+			cc:       &testConnection{res: []byte{}},
+			wantReq:  &lrpb.DeleteOperationRequest{Name: "operations/abc"},
+			wantCode: http.StatusOK,
+			wantBody: `{}`,
+		},
+		{
+			name:     "invalid query parameter",
+			method:   http.MethodGet,
+			target:   "/v1/operations?page_size=five",
+			cc:       &testConnection{},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "backend error",
+			method:   http.MethodGet,
+			target:   "/v1/operations/abc",
+			cc:       &testConnection{err: status.Error(codes.NotFound, "no such operation")},
+			wantCode: http.StatusNotFound,
+			wantBody: `{"code":5,"message":"nosuchoperation"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: tt.cc}
+			r := mux.NewRouter()
+			f.registerREST(r)
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.wantCode {
+				t.Errorf("restHandler() %s code: got = %d, want = %d", tt.name, resp.Code, tt.wantCode)
+			}
+
+			if tt.wantBody != "" && compactJSON(resp.Body.String()) != tt.wantBody {
+				t.Errorf("restHandler() %s body: got = %s, want = %s", tt.name, resp.Body.String(), tt.wantBody)
+			}
+
+			if tt.wantReq != nil {
+				got := tt.wantReq.ProtoReflect().New().Interface()
+				if err := proto.Unmarshal(tt.cc.req, got); err != nil || !proto.Equal(got, tt.wantReq) {
+					t.Errorf("restHandler() %s request: got = %v (%v), want = %v", tt.name, got, err, tt.wantReq)
+				}
+			}
+		})
+	}
+}
+
+func TestFallbackServer_restOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		method string
+		want   string
+	}{
+		{name: "delete", target: "/v1/operations/abc", method: http.MethodDelete, want: "POST, DELETE"},
+		{name: "get", target: "/v1/operations/abc", method: http.MethodGet, want: "POST, GET"},
+		{name: "policy method", target: "/v1/operations/abc:cancel", method: http.MethodPost, want: "POST"},
+		{name: "unserved method", target: "/v1/operations/abc", method: http.MethodPut, want: "POST"},
+		{name: "method of another path", target: "/v1/operations", method: http.MethodDelete, want: "POST"},
+		{name: "list", target: "/v1/operations", method: http.MethodGet, want: "POST, GET"},
+	}
+	for _, tt := range tests {
+		r, err := NewHandler(&testConnection{}, WithRESTRoutes())
+		if err != nil {
+			t.Fatalf("NewHandler() %s: %v", tt.name, err)
+		}
+
+		req := httptest.NewRequest(http.MethodOptions, tt.target, nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", tt.method)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		if got := resp.Header().Get("Access-Control-Allow-Methods"); resp.Code != http.StatusOK || got != tt.want {
+			t.Errorf("restOptions() %s: got = %d %s, want = %d %s", tt.name, resp.Code, got, http.StatusOK, tt.want)
+		}
+	}
+}
+
+func Test_restRoute_selectors(t *testing.T) {
+	rt, err := newRESTRoute(operationsMethod("WaitOperation"), &annotations.HttpRule{
+		Pattern:      &annotations.HttpRule_Post{Post: "/v1/{name=operations/*}:wait"},
+		Body:         "timeout",
+		ResponseBody: "name",
+	})
+	if err != nil {
+		t.Fatalf("newRESTRoute(): %v", err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc(rt.path, func(w http.ResponseWriter, r *http.Request) {
+		b, err := rt.request(r)
+		if err != nil {
+			t.Fatalf("request(): %v", err)
+		}
+
+		got := &lrpb.WaitOperationRequest{}
+		want := &lrpb.WaitOperationRequest{Name: "operations/abc", Timeout: durationpb.New(5 * time.Second)}
+		if err := proto.Unmarshal(b, got); err != nil || !proto.Equal(got, want) {
+			t.Errorf("request() body selector: got = %v (%v), want = %v", got, err, want)
+		}
+	})
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/operations/abc:wait", strings.NewReader(`"5s"`)))
+	if resp.Code != http.StatusOK {
+		t.Errorf("request() body selector: got = %d, want = %d", resp.Code, http.StatusOK)
+	}
+
+	res, _ := proto.Marshal(&lrpb.Operation{Name: "operations/abc"})
+	if got, err := rt.response(res); err != nil || string(got) != `"operations/abc"` {
+		t.Errorf("response() response body selector: got = %s (%v), want = %s", got, err, `"operations/abc"`)
+	}
+}
+
+func Test_restRoutes(t *testing.T) {
+	routes := restRoutes([]protoreflect.ServiceDescriptor{operationsMethod("GetOperation").Parent().(protoreflect.ServiceDescriptor)}, slog.Default())
+	if len(routes) == 0 {
+		t.Fatalf("restRoutes(): got no routes")
+	}
+
+	// routes with custom verbs must come first
+	if !routes[0].verb {
+		t.Errorf("restRoutes(): got = %s first, want a custom verb route", routes[0].path)
+	}
+}
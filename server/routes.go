@@ -0,0 +1,233 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Route sends the requests for the services it matches to a backend.
+type Route struct {
+	// Service is the fully-qualified name of the service routed, like
+	// "google.example.v1.Echo", or a package prefix of the names of the
+	// services routed, like "google.example.*". A lone "*" matches any
+	// service. The most specific route matching a service is used.
+	Service string `json:"service"`
+
+	// Backend is the address of the gRPC backend.
+	Backend string `json:"backend"`
+
+	// Transport secures the connection to the backend. Without it, the
+	// connection is secured like that of the server's default backend.
+	Transport *TransportSecurity `json:"transport,omitempty"`
+}
+
+// LoadRoutes reads the routes from the given JSON file, of the form:
+//
+//	{
+//	  "routes": [
+//	    {"service": "google.example.v1.*", "backend": "localhost:7469"},
+//	    {"service": "google.other.v1.Other", "backend": "other:443", "transport": {"ca_file": "ca.pem"}}
+//	  ]
+//	}
+func LoadRoutes(path string) ([]Route, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading routes: %v", err)
+	}
+
+	var cfg struct {
+		Routes []Route `json:"routes"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("error parsing routes %s: %v", path, err)
+	}
+
+	for _, rt := range cfg.Routes {
+		if err := rt.validate(); err != nil {
+			return nil, fmt.Errorf("invalid route in %s: %v", path, err)
+		}
+	}
+
+	return cfg.Routes, nil
+}
+
+// validate reports whether the route is complete, and its service pattern valid.
+func (rt Route) validate() error {
+	if rt.Backend == "" {
+		return fmt.Errorf("missing backend for service %q", rt.Service)
+	}
+
+	svc := strings.TrimSuffix(rt.Service, "*")
+	if rt.Service == "" || strings.Contains(svc, "*") || (svc != rt.Service && svc != "" && !strings.HasSuffix(svc, ".")) {
+		return fmt.Errorf("invalid service %q, want a service name, package.*, or *", rt.Service)
+	}
+
+	return nil
+}
+
+// match reports whether the route matches the given service.
+func (rt Route) match(service string) bool {
+	if prefix := strings.TrimSuffix(rt.Service, "*"); prefix != rt.Service {
+		return strings.HasPrefix(service, prefix)
+	}
+
+	return rt.Service == service
+}
+
+// routedConnection is a connection that sends each call to the
+// backend of the most specific route matching its service.
+type routedConnection struct {
+	// routes are ordered from the most to the least specific
+	routes []Route
+	conns  []connection
+
+	// fallback serves services without a route, if any
+	fallback connection
+}
+
+// backendKey identifies the connections that routes can share.
+type backendKey struct {
+	backend   string
+	transport TransportSecurity
+	explicit  bool
+}
+
+// dialRoutes dials a connection for each distinct backend of the routes.
+// Services without a route are sent to the server's default backend, if
+// there is one, and are otherwise rejected with a NotFound status.
+func (f *FallbackServer) dialRoutes() (*routedConnection, error) {
+	routes := append([]Route{}, f.routes...)
+	for _, rt := range routes {
+		if err := rt.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	// exact names take precedence over prefixes, and longer prefixes
+	// over shorter ones
+	sort.SliceStable(routes, func(i, j int) bool {
+		iExact, jExact := !strings.HasSuffix(routes[i].Service, "*"), !strings.HasSuffix(routes[j].Service, "*")
+		if iExact != jExact {
+			return iExact
+		}
+		return len(routes[i].Service) > len(routes[j].Service)
+	})
+
+	conns := make(map[backendKey]connection)
+	connect := func(backend string, ts *TransportSecurity) (connection, error) {
+		if ts == nil {
+			ts = f.transport
+		}
+		key := backendKey{backend: backend, explicit: ts != nil}
+		if ts != nil {
+			key.transport = *ts
+		}
+
+		if cc, ok := conns[key]; ok {
+			return cc, nil
+		}
+		cc, err := f.dialBackend(backend, ts)
+		if err != nil {
+			return nil, fmt.Errorf("error dialing %s: %v", backend, err)
+		}
+		conns[key] = cc
+
+		return cc, nil
+	}
+
+	rc := &routedConnection{routes: routes}
+	if f.conn != nil {
+		rc.fallback = codecConnection{f.conn}
+	} else if f.backend != "" {
+		var err error
+		if rc.fallback, err = connect(f.backend, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, rt := range routes {
+		cc, err := connect(rt.Backend, rt.Transport)
+		if err != nil {
+			return nil, err
+		}
+		rc.conns = append(rc.conns, cc)
+	}
+
+	return rc, nil
+}
+
+// route returns the connection serving the given method,
+// in the form built by buildMethod.
+func (rc *routedConnection) route(method string) (connection, error) {
+	service := strings.TrimPrefix(method, "/")
+	if i := strings.LastIndex(service, "/"); i >= 0 {
+		service = service[:i]
+	}
+
+	for i, rt := range rc.routes {
+		if rt.match(service) {
+			return rc.conns[i], nil
+		}
+	}
+	if rc.fallback != nil {
+		return rc.fallback, nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "unknown service %s", service)
+}
+
+// backends lists the distinct backend connections, the fallback first.
+func (rc *routedConnection) backends() []connection {
+	var backends []connection
+	seen := make(map[connection]bool)
+	for _, cc := range append([]connection{rc.fallback}, rc.conns...) {
+		if cc != nil && !seen[cc] {
+			seen[cc] = true
+			backends = append(backends, cc)
+		}
+	}
+
+	return backends
+}
+
+func (rc *routedConnection) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	cc, err := rc.route(method)
+	if err != nil {
+		return err
+	}
+
+	return cc.Invoke(ctx, method, args, reply, opts...)
+}
+
+func (rc *routedConnection) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cc, err := rc.route(method)
+	if err != nil {
+		return nil, err
+	}
+
+	return cc.NewStream(ctx, desc, method, opts...)
+}
@@ -0,0 +1,264 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+func TestLoadRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    []Route
+		wantErr string
+	}{
+		{
+			name: "basic",
+			config: `{"routes": [
+				{"service": "google.example.v1.*", "backend": "localhost:7469"},
+				{"service": "google.other.v1.Other", "backend": "other:443", "transport": {"ca_file": "ca.pem", "server_name": "other.internal"}}
+			]}`,
+			want: []Route{
+				{Service: "google.example.v1.*", Backend: "localhost:7469"},
+				{Service: "google.other.v1.Other", Backend: "other:443", Transport: &TransportSecurity{CAFile: "ca.pem", ServerName: "other.internal"}},
+			},
+		},
+		{name: "any service", config: `{"routes": [{"service": "*", "backend": "localhost:7469"}]}`, want: []Route{{Service: "*", Backend: "localhost:7469"}}},
+		{name: "unknown field", config: `{"routes": [{"service": "a.B", "address": "localhost:7469"}]}`, wantErr: "error parsing routes"},
+		{name: "invalid JSON", config: `{"routes": [`, wantErr: "error parsing routes"},
+		{name: "missing backend", config: `{"routes": [{"service": "a.B"}]}`, wantErr: "missing backend"},
+		{name: "missing service", config: `{"routes": [{"backend": "localhost:7469"}]}`, wantErr: "invalid service"},
+		{name: "partial wildcard", config: `{"routes": [{"service": "a.B*", "backend": "localhost:7469"}]}`, wantErr: "invalid service"},
+		{name: "inner wildcard", config: `{"routes": [{"service": "a.*.B", "backend": "localhost:7469"}]}`, wantErr: "invalid service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.json")
+			if err := ioutil.WriteFile(path, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := LoadRoutes(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadRoutes() %s: got err = %v, want = %s", tt.name, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadRoutes() %s: unexpected error: %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadRoutes() %s: got = %+v, want = %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadRoutes(filepath.Join(t.TempDir(), "nope.json")); err == nil || !strings.Contains(err.Error(), "error reading routes") {
+		t.Errorf("LoadRoutes() missing file: got err = %v, want = error reading routes", err)
+	}
+}
+
+func TestRoutedConnection_route(t *testing.T) {
+	exact, pkg, sub, all, fallback := &testConnection{}, &testConnection{}, &testConnection{}, &testConnection{}, &testConnection{}
+
+	tests := []struct {
+		name     string
+		routes   []Route
+		conns    []connection
+		fallback connection
+		method   string
+		want     connection
+	}{
+		{
+			name:   "exact",
+			routes: []Route{{Service: "google.example.v1.Echo"}, {Service: "google.example.v1.*"}},
+			conns:  []connection{exact, pkg},
+			method: "/google.example.v1.Echo/Echo",
+			want:   exact,
+		},
+		{
+			name:   "prefix",
+			routes: []Route{{Service: "google.example.v1.Echo"}, {Service: "google.example.v1.*"}},
+			conns:  []connection{exact, pkg},
+			method: "/google.example.v1.Messaging/GetRoom",
+			want:   pkg,
+		},
+		{
+			name:   "longer prefix",
+			routes: []Route{{Service: "google.example.v1.*"}, {Service: "google.example.*"}},
+			conns:  []connection{sub, pkg},
+			method: "/google.example.v1.Echo/Echo",
+			want:   sub,
+		},
+		{
+			name:   "any service",
+			routes: []Route{{Service: "google.example.v1.*"}, {Service: "*"}},
+			conns:  []connection{pkg, all},
+			method: "/grpc.health.v1.Health/Check",
+			want:   all,
+		},
+		{
+			name:     "fallback",
+			routes:   []Route{{Service: "google.example.v1.*"}},
+			conns:    []connection{pkg},
+			fallback: fallback,
+			method:   "/grpc.health.v1.Health/Check",
+			want:     fallback,
+		},
+		{
+			name:   "package prefix is not a name prefix",
+			routes: []Route{{Service: "google.example.v1.*"}},
+			conns:  []connection{pkg},
+			method: "/google.example.v1beta1.Echo/Echo",
+		},
+		{
+			name:   "unknown",
+			routes: []Route{{Service: "google.example.v1.Echo"}},
+			conns:  []connection{exact},
+			method: "/google.example.v1.EchoTwo/Echo",
+		},
+	}
+	for _, tt := range tests {
+		rc := &routedConnection{routes: tt.routes, conns: tt.conns, fallback: tt.fallback}
+
+		got, err := rc.route(tt.method)
+		if tt.want == nil {
+			if status.Code(err) != codes.NotFound {
+				t.Errorf("routedConnection.route() %s: got err = %v, want = %v", tt.name, err, codes.NotFound)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("routedConnection.route() %s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("routedConnection.route() %s: got = %p, want = %p", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFallbackServer_dialRoutes(t *testing.T) {
+	f := &FallbackServer{
+		backend: "localhost:1234",
+		routes: []Route{
+			{Service: "google.example.*", Backend: "localhost:2000"},
+			{Service: "google.example.v1.Echo", Backend: "localhost:3000", Transport: &TransportSecurity{Plaintext: true}},
+			{Service: "google.other.*", Backend: "localhost:2000"},
+			{Service: "google.more.*", Backend: "localhost:2000", Transport: &TransportSecurity{Plaintext: true}},
+		},
+	}
+
+	cc, err := f.dial()
+	if err != nil {
+		t.Fatalf("FallbackServer.dial() routes: unexpected error: %v", err)
+	}
+	rc, ok := cc.(*routedConnection)
+	if !ok {
+		t.Fatalf("FallbackServer.dial() routes: got = %T, want = *routedConnection", cc)
+	}
+
+	// exact names come first, and routes to the same backend,
+	// with the same transport security, share a connection
+	var got []string
+	for _, cc := range rc.backends() {
+		got = append(got, cc.(*grpc.ClientConn).Target())
+	}
+	want := []string{"localhost:1234", "localhost:3000", "localhost:2000", "localhost:2000"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FallbackServer.dial() routes backends: got = %v, want = %v", got, want)
+	}
+	if rc.routes[0].Service != "google.example.v1.Echo" {
+		t.Errorf("FallbackServer.dial() routes first route: got = %s, want = google.example.v1.Echo", rc.routes[0].Service)
+	}
+
+	// invalid routes and transport security are reported
+	for _, rt := range []Route{
+		{Service: "google.example.*"},
+		{Service: "google.example.*", Backend: "localhost:2000", Transport: &TransportSecurity{Plaintext: true, CAFile: "ca.pem"}},
+	} {
+		f := &FallbackServer{routes: []Route{rt}}
+		if _, err := f.dial(); err == nil {
+			t.Errorf("FallbackServer.dial() invalid route %+v: got err = nil, want error", rt)
+		}
+	}
+}
+
+func TestFallbackServer_routes(t *testing.T) {
+	f := &FallbackServer{
+		cc: &routedConnection{
+			routes: []Route{{Service: "grpc.health.v1.Health"}},
+			conns:  []connection{testBackend(t, false)},
+		},
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc(fallbackPath, f.handler).Headers("Content-Type", protoType)
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	tests := []struct {
+		name       string
+		service    string
+		wantStatus int
+		wantCode   codes.Code
+	}{
+		{name: "routed", service: "grpc.health.v1.Health", wantStatus: http.StatusOK},
+		{name: "unknown", service: "grpc.health.v2.Health", wantStatus: http.StatusNotFound, wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		body, _ := proto.Marshal(&healthpb.HealthCheckRequest{})
+		res, err := http.Post(s.URL+"/$rpc/"+tt.service+"/Check", protoType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("routes() %s: %v", tt.name, err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tt.wantStatus {
+			t.Errorf("routes() %s: got status = %d, want = %d", tt.name, res.StatusCode, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusOK {
+			continue
+		}
+
+		st := &statuspb.Status{}
+		if err := proto.Unmarshal(b, st); err != nil {
+			t.Fatalf("routes() %s: invalid status body %q: %v", tt.name, b, err)
+		}
+		if got := codes.Code(st.GetCode()); got != tt.wantCode {
+			t.Errorf("routes() %s: got code = %v, want = %v", tt.name, got, tt.wantCode)
+		}
+	}
+}
@@ -15,148 +15,553 @@
 package server
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
-const fallbackPath = "/$rpc/{service:[.a-zA-Z0-9]+}/{method:[a-zA-Z]+}"
+const (
+	fallbackPath = "/$rpc/{service:[.a-zA-Z0-9]+}/{method:[a-zA-Z]+}"
+
+	protoType = "application/x-protobuf"
+	jsonType  = "application/json"
+)
 
 // FallbackServer is a grpc-fallback HTTP server.
 type FallbackServer struct {
-	backend string
-	server  http.Server
-	cc      connection //*grpc.ClientConn
+	backend  string
+	server   *http.Server
+	cc       connection //*grpc.ClientConn
+	dialOpts []grpc.DialOption
+
+	// prefix of the paths of the server's endpoints
+	pathPrefix string
+
+	// conn is the connection to the backend supplied by the caller,
+	// instead of dialing it, and dialed are those the server dialed,
+	// which it closes on shutdown
+	conn   grpc.ClientConnInterface
+	dialed []*grpc.ClientConn
+
+	// listener of the server, given or listened on when it starts
+	mu       sync.Mutex
+	listener net.Listener
+
+	// security of the backend connection, if configured explicitly
+	transport *TransportSecurity
+
+	// routes to other backends, by service
+	routes []Route
+
+	// servers of other backends, by host
+	vhosts []*virtualHost
+
+	// HTTPS and cleartext HTTP/2 settings of the listener
+	tls *ServerTLS
+	h2c bool
+
+	// descriptors resolves the services proxied by the server,
+	// combining the configured sources
+	descriptors DescriptorSource
+	sources     []DescriptorSource
+
+	// server reflection settings
+	reflection    bool
+	reflectionTTL time.Duration
+
+	// whether to route REST requests based on
+	// the google.api.http annotations of methods
+	rest bool
+
+	logger       Logger
+	accessLog    Logger
+	cors         *CORSPolicy
+	headers      *HeaderPolicy
+	respMetadata *ResponseMetadataPolicy
+	deadlines    *DeadlinePolicy
+	readiness    *ReadinessPolicy
+
+	// Prometheus metrics and OpenTelemetry tracing
+	// of proxied requests, if enabled
+	metrics *proxyMetrics
+	tracing *Tracing
 }
 
 // connection is an abstraction around the grpc.ClientConn
 // to make testing easier.
 type connection interface {
 	Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error
+	NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error)
 }
 
 // NewServer creates a new grpc-fallback HTTP server on the
 // given port that proxies to the given gRPC server backend.
-func NewServer(port, backend string) *FallbackServer {
+// The server is customized with the given options, if any.
+// The backend may be empty if WithRoutes routes every service, or
+// WithVirtualHost proxies every host.
+func NewServer(port, backend string, opts ...Option) *FallbackServer {
 	if !strings.HasPrefix(port, ":") {
 		port = ":" + port
 	}
 
-	return &FallbackServer{
+	f := &FallbackServer{
 		backend: backend,
-		server: http.Server{
-			Addr: port,
-		},
 	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if f.server == nil {
+		f.server = &http.Server{}
+	}
+	if f.server.Addr == "" {
+		f.server.Addr = port
+	}
+
+	return f
 }
 
 // Start starts the grpc-fallback HTTP server listening on its port,
-// and opens a connection to the gRPC backend.
-func (f *FallbackServer) Start() {
-	// setup connection and handler
-	f.preStart()
+// or its listener if one was given, and opens a connection to the
+// gRPC backend. The server uses HTTPS if its http.Server has a TLS
+// config, such as the one set up by the WithTLS option.
+//
+// Start blocks until the server fails or is shut down, returning the
+// error, which is http.ErrServerClosed after Shutdown, like Serve.
+func (f *FallbackServer) Start() error {
+	if err := f.preStart(); err != nil {
+		return err
+	}
 
-	log.Println("Fallback server listening on port:", f.server.Addr)
-	if err := f.server.ListenAndServe(); err != nil {
-		log.Println("Error in fallback server while listening:", err)
+	l, err := f.listen()
+	if err != nil {
+		return err
 	}
+
+	return f.serve(l)
 }
 
-// StartBackground runs Start() in a goroutine.
-func (f *FallbackServer) StartBackground() {
-	go f.Start()
+// StartBackground starts the server like Start, but serves requests in a
+// goroutine. It returns once the server is listening, so Addr reports its
+// address, or with the error that kept it from starting.
+func (f *FallbackServer) StartBackground() error {
+	if err := f.preStart(); err != nil {
+		return err
+	}
+
+	l, err := f.listen()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := f.serve(l); err != nil && err != http.ErrServerClosed {
+			f.log().Error("Error in fallback server while serving", "error", err)
+		}
+	}()
+
+	return nil
 }
 
-func (f *FallbackServer) preStart() {
+// Serve starts the server like Start, but serves requests on the given
+// listener. It blocks until the server fails or is shut down, returning
+// the error, which is http.ErrServerClosed after Shutdown.
+func (f *FallbackServer) Serve(l net.Listener) error {
+	if err := f.preStart(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.listener = l
+	f.mu.Unlock()
+
+	if _, err := f.listen(); err != nil {
+		return err
+	}
+
+	return f.serve(l)
+}
+
+// Addr returns the address the server is listening on, which is the actual
+// port when it was created with port 0, or nil if it has not started, nor
+// been given a listener.
+func (f *FallbackServer) Addr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.listener == nil {
+		return nil
+	}
+
+	return f.listener.Addr()
+}
+
+// listen returns the listener given to the server, or listens on the
+// server's address, and serves the metrics on their own address, if
+// configured to.
+func (f *FallbackServer) listen() (net.Listener, error) {
+	f.mu.Lock()
+	l := f.listener
+	f.mu.Unlock()
+
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", f.server.Addr); err != nil {
+			return nil, fmt.Errorf("error listening on %s: %v", f.server.Addr, err)
+		}
+
+		f.mu.Lock()
+		f.listener = l
+		f.mu.Unlock()
+	}
+
+	if err := f.startAdmin(); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// serve serves requests on the listener until the server is shut down.
+func (f *FallbackServer) serve(l net.Listener) error {
+	// the certificates are supplied by the TLS config
+	if f.server.TLSConfig != nil {
+		f.log().Info("Fallback server listening with TLS", "address", l.Addr().String())
+		return f.server.ServeTLS(l, "", "")
+	}
+
+	f.log().Info("Fallback server listening", "address", l.Addr().String())
+	return f.server.Serve(l)
+}
+
+// preStart sets up the router of the server, and its connections
+// to backends, returning errors in the server's configuration.
+func (f *FallbackServer) preStart() error {
+	r, err := f.router()
+	if err != nil {
+		return err
+	}
+
+	f.server.Handler = r
+	if f.h2c {
+		f.server.Handler = h2c.NewHandler(r, &http2.Server{})
+	}
+
+	// setup HTTPS, with certificates reloaded as they change
+	if f.tls != nil {
+		cfg, err := f.tls.config(f.log())
+		if err != nil {
+			return fmt.Errorf("error configuring TLS: %v", err)
+		}
+		f.server.TLSConfig = cfg
+	}
+
+	return nil
+}
+
+// router builds the router of the server's endpoints, under its path
+// prefix, if any, and sets up its connections to backends.
+func (f *FallbackServer) router() (*mux.Router, error) {
+	// setup grpc-fallback complient router, with the health endpoints
+	// and routes of virtual hosts taking precedence
+	root := mux.NewRouter()
+	r := root
+	if f.pathPrefix != "" {
+		r = root.PathPrefix(f.pathPrefix).Subrouter()
+	}
+	r.Use(f.withLogger)
+	if f.tracing != nil {
+		r.Use(f.withTracing)
+	}
+	if f.metrics != nil || f.accessLog != nil {
+		r.Use(f.withRecord)
+	}
+	if f.metrics != nil {
+		// handlers, without a server of their own, serve their metrics
+		if f.metrics.addr == "" || f.server == nil {
+			r.Handle(f.metrics.path, f.metrics.handler()).
+				Methods(http.MethodGet)
+		}
+	}
+	r.HandleFunc(healthzPath, f.healthz).
+		Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(readyzPath, f.readyz).
+		Methods(http.MethodGet, http.MethodHead)
+	for _, vh := range f.vhosts {
+		vh.server = f.virtualHost(vh)
+		sr := r.MatcherFunc(vh.match).Subrouter()
+		sr.Use(vh.server.withLogger)
+		if err := vh.server.setup(sr); err != nil {
+			return nil, fmt.Errorf("error setting up virtual host %s: %v", vh.host, err)
+		}
+	}
+	if f.backend != "" || f.conn != nil || len(f.routes) > 0 || len(f.vhosts) == 0 {
+		if err := f.setup(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return root, nil
+}
+
+// setup connects to the gRPC backend, resolves the descriptors
+// of its services, and registers the routes proxying to it.
+func (f *FallbackServer) setup(r *mux.Router) error {
+	if err := f.corsPolicy().validate(); err != nil {
+		return fmt.Errorf("error configuring CORS: %v", err)
+	}
+
 	var err error
 
 	// setup connection to gRPC backend
 	f.cc, err = f.dial()
 	if err != nil {
-		log.Fatal("Error dialing gRPC backend server:", err)
+		return fmt.Errorf("error dialing gRPC backend server: %v", err)
+	}
+
+	// resolve descriptors from the configured sources, falling
+	// back to the backend's server reflection API
+	sources := append([]DescriptorSource{}, f.sources...)
+	if rc, ok := f.cc.(*routedConnection); ok && f.reflection {
+		for _, cc := range rc.backends() {
+			sources = append(sources, newReflectionSource(cc, f.reflectionTTL))
+		}
+	} else if f.reflection {
+		sources = append(sources, newReflectionSource(f.cc, f.reflectionTTL))
+	}
+	switch len(sources) {
+	case 0:
+	case 1:
+		f.descriptors = sources[0]
+	default:
+		f.descriptors = multiSource(sources)
 	}
 
-	// setup grpc-fallback complient router
-	r := mux.NewRouter()
 	r.HandleFunc(fallbackPath, f.options).
 		Methods(http.MethodOptions)
+	r.HandleFunc(fallbackPath, f.sseHandler).
+		Methods(http.MethodGet, http.MethodPost).
+		HeadersRegexp("Accept", eventStreamType)
 	r.HandleFunc(fallbackPath, f.handler).
-		Headers("Content-Type", "application/x-protobuf")
-	f.server.Handler = r
+		Headers("Content-Type", protoType)
+	r.HandleFunc(fallbackPath, f.handler).
+		Headers("Content-Type", protoStreamType)
+	r.HandleFunc(fallbackPath, f.jsonHandler).
+		HeadersRegexp("Content-Type", "^"+jsonType)
+	r.HandleFunc(websocketPath, f.websocketHandler).
+		Methods(http.MethodGet)
+	r.HandleFunc(grpcWebPath, f.grpcWebHandler).
+		Methods(http.MethodPost).
+		HeadersRegexp("Content-Type", grpcWebTypes)
+	if f.rest {
+		f.registerREST(r)
+	}
+	// the preflights of REST routes must reach their own handler first
+	r.HandleFunc(grpcWebPath, f.options).
+		Methods(http.MethodOptions).
+		MatcherFunc(isGRPCWebPreflight)
+
+	return nil
+}
+
+// Shutdown gracefully turns down the grpc-fallback HTTP server, and the
+// server of its metrics, if any, waiting for in-flight requests to complete
+// until the context is done, at which point the remaining connections are
+// closed. The connections to the gRPC backends are closed last. Hijacked
+// connections, such as those of WebSockets, are not waited for.
+func (f *FallbackServer) Shutdown(ctx context.Context) error {
+	err := f.server.Shutdown(ctx)
+	if err != nil {
+		f.server.Close()
+	}
+	if adminErr := f.shutdownAdmin(ctx); err == nil {
+		err = adminErr
+	}
+
+	if closeErr := f.closeBackends(); err == nil {
+		err = closeErr
+	}
+
+	return err
 }
 
-// Shutdown turns down the grpc-fallback HTTP server.
-func (f *FallbackServer) Shutdown() {
-	if err := f.server.Shutdown(context.Background()); err != nil {
-		log.Println("Error shutting down fallback server:", err)
+// closeBackends closes the connections dialed by the server,
+// and by the servers of its virtual hosts.
+func (f *FallbackServer) closeBackends() error {
+	var err error
+	for _, cc := range f.dialed {
+		if closeErr := cc.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for _, vh := range f.vhosts {
+		if vh.server == nil {
+			continue
+		}
+		if closeErr := vh.server.closeBackends(); err == nil {
+			err = closeErr
+		}
 	}
+
+	return err
 }
 
 // handler is a generic HTTP handler that invokes the proper
 // RPC given the grpc-fallback HTTP request.
 func (f *FallbackServer) handler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Incoming grpc-fallback request:", r.RequestURI)
+	logger(r).Debug("Incoming grpc-fallback request", "uri", r.RequestURI)
 	v := mux.Vars(r)
 
 	// craft service-method path
 	m := buildMethod(v["service"], v["method"])
 
+	// allow the origins permitted by the CORS policy
+	f.corsPolicy().apply(w, r)
+
 	// copy headers into out-going context metadata
-	ctx := prepareHeaders(context.Background(), r.Header)
+	ctx, cancel, err := f.requestContext(r, m)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
 
-	// preemptively allow all origins in response
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// fail fast on methods the backend is known not to serve
+	md, err := f.findMethod(v["service"], v["method"])
+	if f.descriptors != nil && status.Code(err) == codes.NotFound {
+		writeError(w, r, err)
+		return
+	}
 
-	// invoke the RPC, supplying the request body
-	// and response writer directly
-	err := f.cc.Invoke(ctx, m, r.Body, w)
-	if err != nil {
-		code := 500
-		b := []byte(err.Error())
+	// stream the length-delimited messages of streamed request bodies, to
+	// client-streaming methods, while other bodies are a single message
+	if r.Header.Get("Content-Type") == protoStreamType {
+		switch {
+		case err != nil:
+			writeError(w, r, status.Errorf(codes.FailedPrecondition, "streamed requests require the descriptors of method %s: %v", m, err))
+		case !md.IsStreamingClient():
+			writeError(w, r, status.Errorf(codes.InvalidArgument, "method %s is not client-streaming", m))
+		default:
+			f.clientStream(ctx, w, r, m, md, newDelimitedReader(r.Body), protoFramer{})
+		}
+		return
+	}
 
-		// handle gRPC specific errors
-		if st, ok := status.FromError(err); ok {
-			code = httpStatusFromCode(st.Code())
-			b, _ = proto.Marshal(st.Proto())
+	// stream the responses of server-streaming methods
+	if err == nil && md.IsStreamingServer() {
+		req, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, status.Errorf(codes.InvalidArgument, "error reading request body: %v", err))
+			return
 		}
 
-		log.Println("Error handling request:", r.RequestURI, "-", err)
-		w.WriteHeader(code)
-		w.Write(b)
+		f.serverStream(ctx, w, r, m, req, protoFramer{})
+		return
+	}
+
+	// invoke the RPC, supplying the request body directly, and
+	// buffering the response until its metadata has been written
+	var header, trailer metadata.MD
+	res := &bytes.Buffer{}
+	err = f.cc.Invoke(ctx, m, r.Body, res, grpc.Header(&header), grpc.Trailer(&trailer))
+	f.writeHeaderMetadata(w, header, trailer)
+	defer f.writeTrailerMetadata(w, trailer, false)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write(res.Bytes())
+}
+
+// writeError writes the given error to the response. gRPC errors are
+// written as a serialized google.rpc.Status, along with the corresponding
+// HTTP status, anything else is a 500 with the error message as the body.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := 500
+	b := []byte(err.Error())
+
+	// handle gRPC specific errors
+	if st, ok := status.FromError(err); ok {
+		code = httpStatusFromCode(st.Code())
+		b, _ = proto.Marshal(st.Proto())
 	}
+
+	logger(r).Debug("Error handling request", "uri", r.RequestURI, "error", err)
+	recordCode(r, status.Code(err))
+	w.WriteHeader(code)
+	w.Write(b)
 }
 
-// dial creates a connection with the gRPC service backend.
+// dial creates the connection with the gRPC service backend, or
+// backends, if the server has routes.
 func (f *FallbackServer) dial() (connection, error) {
+	if len(f.routes) > 0 {
+		rc, err := f.dialRoutes()
+		if err != nil {
+			return nil, err
+		}
+		return rc, nil
+	}
+	if f.conn != nil {
+		return codecConnection{f.conn}, nil
+	}
+
+	return f.dialBackend(f.backend, f.transport)
+}
+
+// dialBackend creates a connection with the given gRPC backend, secured
+// with the given settings, if any.
+func (f *FallbackServer) dialBackend(backend string, ts *TransportSecurity) (connection, error) {
 	opts := []grpc.DialOption{
 		grpc.WithDefaultCallOptions(grpc.ForceCodec(fallbackCodec{})),
 	}
 
-	// default to basic CA, use insecure if on localhost
+	// use the configured transport security, or default to basic CA,
+	// using insecure if on localhost
 	auth := grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))
-	if strings.Contains(f.backend, "localhost") || strings.Contains(f.backend, "127.0.0.1") {
+	if ts != nil {
+		var err error
+		if auth, err = ts.dialOption(); err != nil {
+			return nil, err
+		}
+	} else if strings.Contains(backend, "localhost") || strings.Contains(backend, "127.0.0.1") {
 		auth = grpc.WithInsecure()
 	}
 	opts = append(opts, auth)
+	opts = append(opts, f.dialOpts...)
+
+	cc, err := grpc.Dial(backend, opts...)
+	if err != nil {
+		return nil, err
+	}
+	f.dialed = append(f.dialed, cc)
 
-	return grpc.Dial(f.backend, opts...)
+	return cc, nil
 }
 
 // options is a handler for the OPTIONS call that precedes CORS-enabled calls.
 func (f *FallbackServer) options(w http.ResponseWriter, r *http.Request) {
-	log.Println("Incoming OPTIONS for request:", r.RequestURI)
-	w.Header().Add("access-control-allow-credentials", "true")
-	w.Header().Add("access-control-allow-headers", "*")
-	w.Header().Add("access-control-allow-methods", http.MethodPost)
-	w.Header().Add("access-control-allow-origin", "*")
-	w.Header().Add("access-control-max-age", "3600")
+	logger(r).Debug("Incoming OPTIONS for request", "uri", r.RequestURI)
+	f.corsPolicy().preflight(w, r)
 	w.WriteHeader(http.StatusOK)
 }
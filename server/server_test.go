@@ -15,23 +15,35 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/mux"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
 )
 
 func TestNewServer(t *testing.T) {
 	type args struct {
 		port    string
 		backend string
+		opts    []Option
 	}
 	tests := []struct {
 		name string
@@ -46,7 +58,7 @@ func TestNewServer(t *testing.T) {
 			},
 			want: &FallbackServer{
 				backend: "localhost:4321",
-				server: http.Server{
+				server: &http.Server{
 					Addr: ":1234",
 				},
 			},
@@ -59,15 +71,44 @@ func TestNewServer(t *testing.T) {
 			},
 			want: &FallbackServer{
 				backend: "localhost:4321",
-				server: http.Server{
+				server: &http.Server{
 					Addr: ":1234",
 				},
 			},
 		},
+		{
+			name: "custom http server",
+			args: args{
+				port:    "1234",
+				backend: "localhost:4321",
+				opts:    []Option{WithHTTPServer(&http.Server{ReadHeaderTimeout: time.Second})},
+			},
+			want: &FallbackServer{
+				backend: "localhost:4321",
+				server: &http.Server{
+					Addr:              ":1234",
+					ReadHeaderTimeout: time.Second,
+				},
+			},
+		},
+		{
+			name: "custom http server address",
+			args: args{
+				port:    "1234",
+				backend: "localhost:4321",
+				opts:    []Option{WithHTTPServer(&http.Server{Addr: "127.0.0.1:8080"})},
+			},
+			want: &FallbackServer{
+				backend: "localhost:4321",
+				server: &http.Server{
+					Addr: "127.0.0.1:8080",
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewServer(tt.args.port, tt.args.backend); !reflect.DeepEqual(got, tt.want) {
+			if got := NewServer(tt.args.port, tt.args.backend, tt.args.opts...); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NewServer() = %v, want %v", got, tt.want)
 			}
 		})
@@ -76,10 +117,137 @@ func TestNewServer(t *testing.T) {
 
 type testConnection struct {
 	err error
+	req []byte
+	res []byte
 }
 
 func (c *testConnection) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
-	return c.err
+	if c.err != nil {
+		return c.err
+	}
+
+	// record the request payload and supply the canned response,
+	// just as the codec would when talking to a real backend
+	if args != nil {
+		var err error
+		if c.req, err = (fallbackCodec{}).Marshal(args); err != nil {
+			return err
+		}
+	}
+	if c.res != nil {
+		return fallbackCodec{}.Unmarshal(c.res, reply)
+	}
+
+	return nil
+}
+
+func (c *testConnection) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, status.Error(codes.Unimplemented, "streaming is not supported by testConnection")
+}
+
+// testHealthServer is a health service whose behavior is controlled by the
+// service name in the request. "error" fails the RPC outright, "fail" fails
+// Watch after it has sent its responses, "metadata" sends testHeader
+// and testTrailer, and "slow" waits for Check to be canceled. Otherwise, Check reports SERVING and Watch sends SERVING
+// followed by NOT_SERVING.
+type testHealthServer struct {
+	healthpb.UnimplementedHealthServer
+}
+
+var (
+	testHeader  = metadata.Pairs("x-test-header", "value", "x-test-bin", "\x00\x01", "content-type", "application/grpc+fake")
+	testTrailer = metadata.Pairs("x-test-trailer", "done")
+)
+
+func (testHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.GetService() == "metadata" {
+		grpc.SetHeader(ctx, testHeader)
+		grpc.SetTrailer(ctx, testTrailer)
+	}
+	if req.GetService() == "error" {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	if req.GetService() == "slow" {
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (testHealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if req.GetService() == "metadata" {
+		stream.SetHeader(testHeader)
+		stream.SetTrailer(testTrailer)
+	}
+	if req.GetService() == "error" {
+		return status.Error(codes.NotFound, "unknown service")
+	}
+
+	for _, st := range []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING} {
+		if err := stream.Send(&healthpb.HealthCheckResponse{Status: st}); err != nil {
+			return err
+		}
+	}
+
+	if req.GetService() == "fail" {
+		return status.Error(codes.Internal, "failed")
+	}
+
+	return nil
+}
+
+// testBackend starts an in-memory gRPC server with the given options,
+// registered with the test health and upload services, and returns a
+// fallback connection to it.
+func testBackend(t *testing.T, withReflection bool, opts ...grpc.ServerOption) connection {
+	return dialTestBackend(t, "bufnet", testListener(t, withReflection, opts...))
+}
+
+// testListener starts an in-memory gRPC server like testBackend, and
+// returns its listener, for tests dialing it in their own way.
+func testListener(t *testing.T, withReflection bool, opts ...grpc.ServerOption) *bufconn.Listener {
+	s := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(s, testHealthServer{})
+	testpb.RegisterTestServiceServer(s, testUploadServer{})
+	if withReflection {
+		reflection.Register(s)
+	}
+
+	return serveTestServer(t, s)
+}
+
+// serveTestServer serves the given gRPC server in memory until the
+// test ends, and returns its listener.
+func serveTestServer(t *testing.T, s *grpc.Server) *bufconn.Listener {
+	lis := bufconn.Listen(1024 * 1024)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return lis
+}
+
+// testDialer returns the dial option connecting to the given listener.
+func testDialer(lis *bufconn.Listener) grpc.DialOption {
+	return grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() })
+}
+
+// dialTestBackend returns a fallback connection to the given
+// listener, with the given target.
+func dialTestBackend(t *testing.T, target string, lis *bufconn.Listener) connection {
+	cc, err := grpc.Dial(target,
+		testDialer(lis),
+		grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(fallbackCodec{})))
+	if err != nil {
+		t.Fatalf("error dialing test backend: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	return cc
 }
 
 type testRespWriter struct {
@@ -195,26 +363,46 @@ func TestFallbackServer_handler(t *testing.T) {
 	}
 }
 
+type testCredentials struct{}
+
+func (testCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (testCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
 func TestFallbackServer_dial(t *testing.T) {
+	// dial options are applied, so credentials requiring transport
+	// security are rejected when dialing an insecure local backend
+	secure := []grpc.DialOption{grpc.WithPerRPCCredentials(testCredentials{})}
+
 	tests := []struct {
-		backend string
-		name    string
-		want    string
-		wantErr bool
+		backend  string
+		dialOpts []grpc.DialOption
+		name     string
+		want     string
+		wantErr  bool
 	}{
 		{name: "basic localhost", backend: "localhost:1234", want: "localhost:1234"},
 		{name: "basic non-local", backend: "test.api.dev:443", want: "test.api.dev:443"},
+		{name: "dial options", backend: "localhost:1234", dialOpts: secure, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			f := &FallbackServer{
-				backend: tt.backend,
+				backend:  tt.backend,
+				dialOpts: tt.dialOpts,
 			}
 			got, err := f.dial()
 			if (err != nil) != tt.wantErr {
 				t.Errorf("FallbackServer.dial() %s error = %v, wantErr = %v", tt.name, err, tt.wantErr)
 				return
 			}
+			if err != nil {
+				return
+			}
 
 			gotTarget := got.(*grpc.ClientConn).Target()
 			if gotTarget != tt.want {
@@ -227,13 +415,13 @@ func TestFallbackServer_dial(t *testing.T) {
 func TestFallbackServer_preStart(t *testing.T) {
 	type fields struct {
 		backend string
-		server  http.Server
+		server  *http.Server
 	}
 	tests := []struct {
 		name   string
 		fields fields
 	}{
-		{name: "basic", fields: fields{backend: "localhost:1234", server: http.Server{}}},
+		{name: "basic", fields: fields{backend: "localhost:1234", server: &http.Server{}}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -241,7 +429,9 @@ func TestFallbackServer_preStart(t *testing.T) {
 				backend: tt.fields.backend,
 				server:  tt.fields.server,
 			}
-			f.preStart()
+			if err := f.preStart(); err != nil {
+				t.Fatalf("FallbackServer.preStart() %s: unexpected error: %v", tt.name, err)
+			}
 
 			if _, ok := f.server.Handler.(*mux.Router); !ok {
 				t.Errorf("FallbackServer.preStart() %s handler: got = %v, want = mux.Router", tt.name, f.server.Handler)
@@ -250,11 +440,133 @@ func TestFallbackServer_preStart(t *testing.T) {
 	}
 }
 
+func TestFallbackServer_preStart_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		opts    []Option
+		wantErr string
+	}{
+		{name: "TLS", backend: "localhost:1234", opts: []Option{WithTLS(ServerTLS{CertFile: "missing.pem", KeyFile: "missing.pem"})}, wantErr: "error configuring TLS"},
+		{name: "route", opts: []Option{WithRoutes(Route{Service: "a.B"})}, wantErr: "error dialing gRPC backend server"},
+		{name: "CORS", backend: "localhost:1234", opts: []Option{WithCORSPolicy(CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true})}, wantErr: "error configuring CORS"},
+		{name: "virtual host", opts: []Option{WithVirtualHost("foo.example.test", "localhost:2000", WithRoutes(Route{Service: "a.*"}))}, wantErr: "error setting up virtual host foo.example.test"},
+	}
+	for _, tt := range tests {
+		f := NewServer("0", tt.backend, tt.opts...)
+
+		// errors are returned rather than exiting
+		if err := f.Start(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("FallbackServer.Start() %s: got err = %v, want = %s", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// lifecycleBackend returns the dial options of an in-memory test backend.
+func lifecycleBackend(t *testing.T) []grpc.DialOption {
+	return []grpc.DialOption{testDialer(testListener(t, false)), grpc.WithInsecure()}
+}
+
+func TestFallbackServer_StartBackground(t *testing.T) {
+	f := NewServer("0", "bufnet", WithDialOptions(lifecycleBackend(t)...), WithHTTPServer(&http.Server{Addr: "127.0.0.1:0"}))
+	if got := f.Addr(); got != nil {
+		t.Errorf("FallbackServer.Addr() before start: got = %v, want = nil", got)
+	}
+	if err := f.StartBackground(); err != nil {
+		t.Fatalf("FallbackServer.StartBackground(): unexpected error: %v", err)
+	}
+
+	addr, ok := f.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("FallbackServer.Addr(): got = %v, want listening port", f.Addr())
+	}
+
+	// a request in flight when shutting down completes, once the
+	// deadline of its backend call is exceeded
+	done := make(chan *http.Response, 1)
+	go func() {
+		body, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "slow"})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr.String()+"/$rpc/grpc.health.v1.Health/Check", bytes.NewReader(body))
+		req.Header.Set("Content-Type", protoType)
+		req.Header.Set("X-Server-Timeout", "0.5")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("FallbackServer.Shutdown() in-flight request: %v", err)
+			done <- nil
+			return
+		}
+		res.Body.Close()
+		done <- res
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.Shutdown(ctx); err != nil {
+		t.Errorf("FallbackServer.Shutdown(): unexpected error: %v", err)
+	}
+	if res := <-done; res != nil && res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("FallbackServer.Shutdown() in-flight request: got status = %d, want = %d", res.StatusCode, http.StatusGatewayTimeout)
+	}
+
+	// the backend connection is closed, and so is the listener
+	if got := f.cc.(*grpc.ClientConn).GetState(); got != connectivity.Shutdown {
+		t.Errorf("FallbackServer.Shutdown() backend: got state = %v, want = %v", got, connectivity.Shutdown)
+	}
+	if _, err := http.Get("http://" + addr.String() + healthzPath); err == nil {
+		t.Errorf("FallbackServer.Shutdown() listener: got err = nil, want error")
+	}
+
+	// the port is taken by another server
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer taken.Close()
+	g := NewServer("0", "bufnet", WithDialOptions(lifecycleBackend(t)...), WithHTTPServer(&http.Server{Addr: taken.Addr().String()}))
+	if err := g.StartBackground(); err == nil || !strings.Contains(err.Error(), "error listening") {
+		t.Errorf("FallbackServer.StartBackground() port taken: got err = %v, want = error listening", err)
+	}
+}
+
+func TestFallbackServer_Serve(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	f := NewServer("0", "bufnet", WithDialOptions(lifecycleBackend(t)...))
+	served := make(chan error, 1)
+	go func() { served <- f.Serve(lis) }()
+
+	// wait for the server to serve on the listener
+	for i := 0; f.Addr() == nil && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := f.Addr(); got == nil || got.String() != lis.Addr().String() {
+		t.Fatalf("FallbackServer.Addr(): got = %v, want = %v", got, lis.Addr())
+	}
+
+	res, err := http.Get("http://" + lis.Addr().String() + healthzPath)
+	if err != nil {
+		t.Fatalf("FallbackServer.Serve(): %v", err)
+	}
+	res.Body.Close()
+
+	if err := f.Shutdown(context.Background()); err != nil {
+		t.Errorf("FallbackServer.Shutdown(): unexpected error: %v", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("FallbackServer.Serve(): got err = %v, want = %v", err, http.ErrServerClosed)
+	}
+}
+
 func TestFallbackServer_options(t *testing.T) {
 	type fields struct {
 		backend string
-		server  http.Server
+		server  *http.Server
 		cc      connection
+		cors    *CORSPolicy
 	}
 	type args struct {
 		w http.ResponseWriter
@@ -263,12 +575,19 @@ func TestFallbackServer_options(t *testing.T) {
 
 	req, _ := http.NewRequest("OPTIONS", "/test", nil)
 	hdr := make(http.Header)
-	hdr.Add("access-control-allow-credentials", "true")
 	hdr.Add("access-control-allow-headers", "*")
 	hdr.Add("access-control-allow-methods", http.MethodPost)
 	hdr.Add("access-control-allow-origin", "*")
 	hdr.Add("access-control-max-age", "3600")
 
+	originReq, _ := http.NewRequest("OPTIONS", "/test", nil)
+	originReq.Header.Set("Origin", "https://example.com")
+	originHdr := make(http.Header)
+	originHdr.Add("access-control-allow-headers", "X-Goog-Api-Key, Content-Type")
+	originHdr.Add("access-control-allow-methods", http.MethodPost)
+	originHdr.Add("access-control-allow-origin", "https://example.com")
+	originHdr.Add("vary", "Origin")
+
 	tests := []struct {
 		name       string
 		fields     fields
@@ -286,6 +605,22 @@ func TestFallbackServer_options(t *testing.T) {
 			},
 			wantHeader: hdr,
 		},
+		{
+			name: "custom policy",
+			args: args{
+				r: originReq,
+				w: &testRespWriter{},
+			},
+			fields: fields{
+				cc: &testConnection{},
+				cors: &CORSPolicy{
+					AllowedOrigins: []string{"https://example.com"},
+					AllowedHeaders: []string{"X-Goog-Api-Key", "Content-Type"},
+					AllowedMethods: []string{http.MethodPost},
+				},
+			},
+			wantHeader: originHdr,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -293,6 +628,7 @@ func TestFallbackServer_options(t *testing.T) {
 				backend: tt.fields.backend,
 				server:  tt.fields.server,
 				cc:      tt.fields.cc,
+				cors:    tt.fields.cors,
 			}
 			f.options(tt.args.w, tt.args.r)
 
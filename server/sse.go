@@ -0,0 +1,188 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const eventStreamType = "text/event-stream"
+
+// sseHandler streams the responses of an RPC as Server-Sent Events. Each
+// response message is sent as a "data" event and the terminal status as a
+// "status" event. Payloads are proto3 JSON if the request was JSON, or if the
+// request message was omitted and the method's descriptors are available.
+// Otherwise, they are base64 encoded protobuf binary.
+//
+// The request message is the body of a POST, or given in the "message" (base64
+// protobuf binary) or "json" (proto3 JSON) query parameter of a GET, which is
+// what browser EventSource clients are limited to.
+func (f *FallbackServer) sseHandler(w http.ResponseWriter, r *http.Request) {
+	logger(r).Debug("Incoming grpc-fallback event stream request", "uri", r.RequestURI)
+	v := mux.Vars(r)
+
+	// allow the origins permitted by the CORS policy
+	f.corsPolicy().apply(w, r)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	md, mdErr := f.findMethod(v["service"], v["method"])
+	useJSON := mdErr == nil
+	fr := &sseFramer{md: md}
+
+	var req []byte
+	var err error
+	switch q := r.URL.Query(); {
+	case r.Method == http.MethodGet && q.Get("message") != "":
+		useJSON = false
+		req, err = decodeBase64(q.Get("message"))
+	case r.Method == http.MethodGet && q.Get("json") != "":
+		useJSON = true
+		req, err = []byte(q.Get("json")), nil
+	case r.Method == http.MethodPost:
+		useJSON = strings.HasPrefix(r.Header.Get("Content-Type"), jsonType)
+		req, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		fr.fail(w, r, status.Errorf(codes.InvalidArgument, "error reading request message: %v", err))
+		return
+	}
+
+	// fail fast on methods the backend is known not to serve,
+	// and on JSON requests the method cannot be transcoded for
+	if (f.descriptors != nil || useJSON) && mdErr != nil {
+		fr.fail(w, r, mdErr)
+		return
+	}
+
+	if useJSON {
+		fr.json = true
+		if req, err = decodeJSON(md.Input(), req); err != nil {
+			fr.fail(w, r, err)
+			return
+		}
+	}
+
+	// copy headers into out-going context metadata
+	m := buildMethod(v["service"], v["method"])
+	ctx, cancel, err := f.requestContext(r, m)
+	if err != nil {
+		fr.fail(w, r, err)
+		return
+	}
+	defer cancel()
+
+	// unary methods are streamed just the same, as a single event
+	f.serverStream(ctx, w, r, m, req, fr)
+}
+
+// sseFramer writes each message as a Server-Sent Event.
+type sseFramer struct {
+	md   protoreflect.MethodDescriptor
+	json bool
+}
+
+func (*sseFramer) contentType() string {
+	return eventStreamType
+}
+
+func (s *sseFramer) message(w io.Writer, b []byte) error {
+	if s.json {
+		var err error
+		if b, err = encodeJSON(s.md.Output(), b); err != nil {
+			return err
+		}
+	} else {
+		b = []byte(base64.StdEncoding.EncodeToString(b))
+	}
+
+	return writeEvent(w, "", b)
+}
+
+func (s *sseFramer) end(w io.Writer, st *status.Status) error {
+	b := jsonStatus(st)
+	if !s.json {
+		pb, err := proto.Marshal(st.Proto())
+		if err != nil {
+			return err
+		}
+		b = []byte(base64.StdEncoding.EncodeToString(pb))
+	}
+
+	return writeEvent(w, "status", b)
+}
+
+// fail sends the error as the status event, rather than as an HTTP error,
+// because EventSource clients cannot read the body of a failed response.
+func (s *sseFramer) fail(w http.ResponseWriter, r *http.Request, err error) {
+	logger(r).Debug("Error handling request", "uri", r.RequestURI, "error", err)
+	recordCode(r, status.Code(err))
+
+	w.Header().Set("Content-Type", eventStreamType)
+	w.WriteHeader(http.StatusOK)
+	s.end(w, status.Convert(err))
+	flush(w)
+}
+
+// single sends the response message in a data event, followed by the status event.
+func (s *sseFramer) single(w http.ResponseWriter, b []byte) error {
+	w.Header().Set("Content-Type", eventStreamType)
+	if err := s.message(w, b); err != nil {
+		return err
+	}
+
+	return s.end(w, status.New(codes.OK, ""))
+}
+
+// writeEvent writes a single event with the given type, if any, and data.
+func writeEvent(w io.Writer, event string, data []byte) error {
+	var sb strings.Builder
+	if event != "" {
+		sb.WriteString("event: " + event + "\n")
+	}
+
+	// each line of the data needs its own field
+	for _, line := range strings.Split(string(data), "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// decodeBase64 decodes s using either the standard or URL-safe
+// base64 alphabet, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		var b []byte
+		if b, err = enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/proto"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestFallbackServer_sseHandler(t *testing.T) {
+	b64 := func(m proto.Message) string {
+		b, _ := proto.Marshal(m)
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	serving := b64(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+	notServing := b64(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+	ok := b64(&statuspb.Status{})
+	failed := b64(&statuspb.Status{Code: 13, Message: "failed"})
+	notFound := b64(&statuspb.Status{Code: 5, Message: "unknown service"})
+	invalid := b64(&statuspb.Status{Code: 3, Message: "error reading request message: illegal base64 data at input byte 0"})
+	fail, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "fail"})
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		wantBody    string
+	}{
+		{
+			name:     "GET json stream",
+			method:   http.MethodGet,
+			target:   "/$rpc/grpc.health.v1.Health/Watch",
+			wantBody: "data: {\"status\":\"SERVING\"}\n\ndata: {\"status\":\"NOT_SERVING\"}\n\nevent: status\ndata: {}\n\n",
+		},
+		{
+			name:     "GET json query",
+			method:   http.MethodGet,
+			target:   "/$rpc/grpc.health.v1.Health/Watch?json=" + url.QueryEscape(`{"service":"fail"}`),
+			wantBody: "data: {\"status\":\"SERVING\"}\n\ndata: {\"status\":\"NOT_SERVING\"}\n\nevent: status\ndata: {\"code\":13,\"message\":\"failed\"}\n\n",
+		},
+		{
+			name:     "GET base64 query",
+			method:   http.MethodGet,
+			target:   "/$rpc/grpc.health.v1.Health/Watch?message=" + url.QueryEscape(base64.URLEncoding.EncodeToString(fail)),
+			wantBody: "data: " + serving + "\n\ndata: " + notServing + "\n\nevent: status\ndata: " + failed + "\n\n",
+		},
+		{
+			name:     "GET unary",
+			method:   http.MethodGet,
+			target:   "/$rpc/grpc.health.v1.Health/Check",
+			wantBody: "data: {\"status\":\"SERVING\"}\n\nevent: status\ndata: {}\n\n",
+		},
+		{
+			name:        "POST protobuf",
+			method:      http.MethodPost,
+			target:      "/$rpc/grpc.health.v1.Health/Watch",
+			contentType: protoType,
+			wantBody:    "data: " + serving + "\n\ndata: " + notServing + "\n\nevent: status\ndata: " + ok + "\n\n",
+		},
+		{
+			name:        "POST protobuf error",
+			method:      http.MethodPost,
+			target:      "/$rpc/grpc.health.v1.Health/Watch",
+			contentType: protoType,
+			body:        []byte("\x0a\x05error"),
+			wantBody:    "event: status\ndata: " + notFound + "\n\n",
+		},
+		{
+			name:        "POST json",
+			method:      http.MethodPost,
+			target:      "/$rpc/grpc.health.v1.Health/Check",
+			contentType: jsonType,
+			body:        []byte(`{"service":"error"}`),
+			wantBody:    "event: status\ndata: {\"code\":5,\"message\":\"unknown service\"}\n\n",
+		},
+		{
+			name:     "GET invalid base64",
+			method:   http.MethodGet,
+			target:   "/$rpc/grpc.health.v1.Health/Check?message=%25%25",
+			wantBody: "event: status\ndata: " + invalid + "\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: testBackend(t, false)}
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.sseHandler)
+
+			var body io.Reader
+			if tt.body != nil {
+				body = bytes.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, body)
+			req.Header.Set("Accept", eventStreamType)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != http.StatusOK {
+				t.Errorf("sseHandler() %s code: got = %d, want = %d", tt.name, resp.Code, http.StatusOK)
+			}
+
+			if ct := resp.Header().Get("Content-Type"); ct != eventStreamType {
+				t.Errorf("sseHandler() %s content-type: got = %s, want = %s", tt.name, ct, eventStreamType)
+			}
+
+			// protojson randomly inserts whitespace into its output
+			if got := resp.Body.String(); strings.ReplaceAll(got, " ", "") != strings.ReplaceAll(tt.wantBody, " ", "") {
+				t.Errorf("sseHandler() %s body:\ngot = %q\nwant = %q", tt.name, got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_writeEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		data  string
+		want  string
+	}{
+		{name: "data only", data: "test", want: "data: test\n\n"},
+		{name: "typed", event: "status", data: "test", want: "event: status\ndata: test\n\n"},
+		{name: "multi-line", data: "a\nb", want: "data: a\ndata: b\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := writeEvent(buf, tt.event, []byte(tt.data)); err != nil || buf.String() != tt.want {
+				t.Errorf("writeEvent() %s: got = %q, %v, want = %q", tt.name, buf.String(), err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// protoStreamType is the content type of a streamed response made
+	// up of length-prefixed protobuf frames, and of a streamed request
+	// made up of length-delimited protobuf messages.
+	protoStreamType = "application/x-protobuf-stream"
+
+	// flags marking the payload of a length-prefixed frame
+	messageFrame byte = 0x00
+	statusFrame  byte = 0x80
+)
+
+// streamFramer frames the messages of a streamed response body.
+type streamFramer interface {
+	// contentType is the content type of the framed response.
+	contentType() string
+
+	// message writes a frame for a protobuf binary response message.
+	message(w io.Writer, b []byte) error
+
+	// end writes the frame carrying the terminal status of the RPC.
+	end(w io.Writer, st *status.Status) error
+
+	// fail writes an error response for an RPC that failed
+	// before any response messages were received.
+	fail(w http.ResponseWriter, r *http.Request, err error)
+
+	// single writes the only response message of an RPC
+	// that is not server-streaming, without any framing.
+	single(w http.ResponseWriter, b []byte) error
+}
+
+// trailerFramer is a streamFramer that also writes the trailer metadata of
+// the response in the frame carrying the terminal status, for clients that
+// do not read HTTP trailers.
+type trailerFramer interface {
+	setTrailer(trailer http.Header)
+}
+
+// serverStream proxies a server-streaming RPC, writing each response message
+// to the client as soon as it is received from the backend. Errors that occur
+// before the first response message are written just like for unary RPCs,
+// afterwards the terminal status is written in the final frame instead.
+func (f *FallbackServer) serverStream(ctx context.Context, w http.ResponseWriter, r *http.Request, method string, req []byte, fr streamFramer) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := f.cc.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, method)
+	if err != nil {
+		fr.fail(w, r, err)
+		return
+	}
+
+	// a failed send surfaces as an error on the first receive
+	if err := stream.SendMsg(bytes.NewReader(req)); err == nil {
+		stream.CloseSend()
+	}
+
+	f.relayResponses(w, r, stream, fr)
+}
+
+// relayResponses writes each message received on the stream to the client,
+// followed by the terminal status. The header metadata of the response is
+// written along with the HTTP headers, and its trailer metadata as HTTP
+// trailers, unless the RPC fails before any response messages.
+func (f *FallbackServer) relayResponses(w http.ResponseWriter, r *http.Request, stream grpc.ClientStream, fr streamFramer) {
+	started := false
+	for {
+		res := &bytes.Buffer{}
+		err := stream.RecvMsg(res)
+		if tf, ok := fr.(trailerFramer); ok && err != nil {
+			tf.setTrailer(f.responseMetadata().trailers(stream.Trailer()))
+		}
+		if err != nil && err != io.EOF && !started {
+			header, _ := stream.Header()
+			f.writeHeaderMetadata(w, header, stream.Trailer())
+			fr.fail(w, r, err)
+			f.writeTrailerMetadata(w, stream.Trailer(), false)
+			return
+		}
+
+		if !started {
+			header, _ := stream.Header()
+			f.writeHeaderMetadata(w, header, nil)
+			w.Header().Set("Content-Type", fr.contentType())
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				logger(r).Debug("Error in response stream", "uri", r.RequestURI, "error", err)
+			}
+
+			st := streamStatus(err)
+			recordCode(r, st.Code())
+			if err := fr.end(w, st); err != nil {
+				logger(r).Debug("Error writing response stream status", "uri", r.RequestURI, "error", err)
+			}
+			f.writeTrailerMetadata(w, stream.Trailer(), true)
+			flush(w)
+			return
+		}
+
+		if err := fr.message(w, res.Bytes()); err != nil {
+			logger(r).Debug("Error writing response stream", "uri", r.RequestURI, "error", err)
+
+			// end the stream if the message could not be encoded,
+			// otherwise the client is gone
+			if st, ok := status.FromError(err); ok {
+				recordCode(r, st.Code())
+				fr.end(w, st)
+			} else {
+				recordCode(r, codes.Canceled)
+			}
+			return
+		}
+		flush(w)
+	}
+}
+
+// flush sends any buffered response data to the client.
+func flush(w http.ResponseWriter) {
+	if fl, ok := w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// protoFramer writes each message in a frame made up of a one byte flag,
+// a four byte big-endian length and the protobuf binary payload. The final
+// frame is flagged as a status frame and carries a google.rpc.Status.
+type protoFramer struct{}
+
+func (protoFramer) contentType() string {
+	return protoStreamType
+}
+
+func (protoFramer) message(w io.Writer, b []byte) error {
+	return writeFrame(w, messageFrame, b)
+}
+
+func (protoFramer) end(w io.Writer, st *status.Status) error {
+	b, err := proto.Marshal(st.Proto())
+	if err != nil {
+		return err
+	}
+
+	return writeFrame(w, statusFrame, b)
+}
+
+func (protoFramer) fail(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, err)
+}
+
+func (protoFramer) single(w http.ResponseWriter, b []byte) error {
+	_, err := w.Write(b)
+	return err
+}
+
+// writeFrame writes a single length-prefixed frame.
+func writeFrame(w io.Writer, flag byte, b []byte) error {
+	hdr := make([]byte, 5)
+	hdr[0] = flag
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// jsonFramer writes the response as a JSON array, in which each message
+// is wrapped in an object as {"result": <message>}, and the last element
+// is the terminal status, wrapped as {"status": <google.rpc.Status>}.
+type jsonFramer struct {
+	md protoreflect.MethodDescriptor
+
+	// whether the opening bracket has been written
+	open bool
+}
+
+func (*jsonFramer) contentType() string {
+	return jsonType
+}
+
+func (j *jsonFramer) message(w io.Writer, b []byte) error {
+	msg, err := encodeJSON(j.md.Output(), b)
+	if err != nil {
+		return err
+	}
+
+	return j.element(w, "result", msg)
+}
+
+func (j *jsonFramer) end(w io.Writer, st *status.Status) error {
+	if err := j.element(w, "status", jsonStatus(st)); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+func (*jsonFramer) fail(w http.ResponseWriter, r *http.Request, err error) {
+	writeJSONError(w, r, err)
+}
+
+func (j *jsonFramer) single(w http.ResponseWriter, b []byte) error {
+	msg, err := encodeJSON(j.md.Output(), b)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(msg)
+	return err
+}
+
+// element writes an array element wrapping the given value in the named field.
+func (j *jsonFramer) element(w io.Writer, name string, value []byte) error {
+	sep := ","
+	if !j.open {
+		sep = "["
+		j.open = true
+	}
+
+	_, err := io.WriteString(w, sep+`{"`+name+`":`+string(value)+"}")
+	return err
+}
+
+// streamStatus converts the error that ended a stream into its
+// terminal status, treating io.EOF as a successful end.
+func streamStatus(err error) *status.Status {
+	if err == io.EOF {
+		return status.New(codes.OK, "")
+	}
+
+	return status.Convert(err)
+}
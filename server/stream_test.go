@@ -0,0 +1,182 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type testFrame struct {
+	flag byte
+	data []byte
+}
+
+// readFrames splits a length-prefixed response body into its frames.
+func readFrames(t *testing.T, body []byte) []testFrame {
+	var frames []testFrame
+	r := bytes.NewReader(body)
+	for {
+		hdr := make([]byte, 5)
+		if _, err := io.ReadFull(r, hdr); err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatalf("error reading frame header: %v", err)
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatalf("error reading frame: %v", err)
+		}
+		frames = append(frames, testFrame{flag: hdr[0], data: data})
+	}
+}
+
+func TestFallbackServer_serverStream_proto(t *testing.T) {
+	tests := []struct {
+		name         string
+		service      string
+		wantCode     int
+		wantStatuses []healthpb.HealthCheckResponse_ServingStatus
+		wantStatus   codes.Code
+	}{
+		{
+			name:         "basic",
+			wantCode:     http.StatusOK,
+			wantStatuses: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING},
+			wantStatus:   codes.OK,
+		},
+		{
+			name:         "error after responses",
+			service:      "fail",
+			wantCode:     http.StatusOK,
+			wantStatuses: []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING},
+			wantStatus:   codes.Internal,
+		},
+		{
+			name:       "error before responses",
+			service:    "error",
+			wantCode:   http.StatusNotFound,
+			wantStatus: codes.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: testBackend(t, false)}
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.handler)
+
+			body, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: tt.service})
+			req := httptest.NewRequest(http.MethodPost, "/$rpc/grpc.health.v1.Health/Watch", bytes.NewReader(body))
+			req.Header.Set("Content-Type", protoType)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.wantCode {
+				t.Fatalf("serverStream() %s code: got = %d, want = %d", tt.name, resp.Code, tt.wantCode)
+			}
+
+			if resp.Code != http.StatusOK {
+				st := &statuspb.Status{}
+				if err := proto.Unmarshal(resp.Body.Bytes(), st); err != nil || codes.Code(st.GetCode()) != tt.wantStatus {
+					t.Errorf("serverStream() %s status: got = %v (%v), want = %v", tt.name, st, err, tt.wantStatus)
+				}
+				return
+			}
+
+			if ct := resp.Header().Get("Content-Type"); ct != protoStreamType {
+				t.Errorf("serverStream() %s content-type: got = %s, want = %s", tt.name, ct, protoStreamType)
+			}
+
+			frames := readFrames(t, resp.Body.Bytes())
+			if len(frames) != len(tt.wantStatuses)+1 {
+				t.Fatalf("serverStream() %s: got = %d frames, want = %d", tt.name, len(frames), len(tt.wantStatuses)+1)
+			}
+
+			for i, want := range tt.wantStatuses {
+				res := &healthpb.HealthCheckResponse{}
+				if frames[i].flag != messageFrame || proto.Unmarshal(frames[i].data, res) != nil || res.GetStatus() != want {
+					t.Errorf("serverStream() %s frame %d: got = %v, want = %v", tt.name, i, frames[i], want)
+				}
+			}
+
+			last := frames[len(frames)-1]
+			st := &statuspb.Status{}
+			if last.flag != statusFrame || proto.Unmarshal(last.data, st) != nil || codes.Code(st.GetCode()) != tt.wantStatus {
+				t.Errorf("serverStream() %s status frame: got = %v, want = %v", tt.name, last, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_serverStream_json(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "basic",
+			body:     `{}`,
+			wantCode: http.StatusOK,
+			wantBody: `[{"result":{"status":"SERVING"}},{"result":{"status":"NOT_SERVING"}},{"status":{}}]`,
+		},
+		{
+			name:     "error after responses",
+			body:     `{"service":"fail"}`,
+			wantCode: http.StatusOK,
+			wantBody: `[{"result":{"status":"SERVING"}},{"result":{"status":"NOT_SERVING"}},{"status":{"code":13,"message":"failed"}}]`,
+		},
+		{
+			name:     "error before responses",
+			body:     `{"service":"error"}`,
+			wantCode: http.StatusNotFound,
+			wantBody: `{"code":5,"message":"unknownservice"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: testBackend(t, false)}
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.jsonHandler)
+
+			req := httptest.NewRequest(http.MethodPost, "/$rpc/grpc.health.v1.Health/Watch", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", jsonType)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.wantCode {
+				t.Errorf("serverStream() %s code: got = %d, want = %d", tt.name, resp.Code, tt.wantCode)
+			}
+
+			if got := compactJSON(resp.Body.String()); got != tt.wantBody {
+				t.Errorf("serverStream() %s body: got = %s, want = %s", tt.name, got, tt.wantBody)
+			}
+		})
+	}
+}
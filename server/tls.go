@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certRecheckInterval is how often the modification times of
+// the certificate and key files are checked during handshakes.
+const certRecheckInterval = 10 * time.Second
+
+// ServerTLS configures HTTPS on the server's listener.
+type ServerTLS struct {
+	// CertFile and KeyFile are the PEM certificate and key of the server.
+	// They are reloaded when either file is modified, which is checked
+	// during handshakes at most every ten seconds.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is a PEM bundle of the CAs trusted to verify client
+	// certificates. Clients are not asked for certificates without it.
+	ClientCAFile string
+
+	// RequireClientCert rejects clients that do not present a certificate
+	// issued by one of the client CAs. Otherwise, clients may omit it.
+	RequireClientCert bool
+}
+
+// config creates the TLS configuration of the server, loading
+// the certificate and key, which must be valid initially.
+func (st ServerTLS) config(l Logger) (*tls.Config, error) {
+	certs := &certReloader{certFile: st.CertFile, keyFile: st.KeyFile, recheck: certRecheckInterval, logger: l}
+	if err := certs.reload(); err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if st.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(st.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA bundle: %v", err)
+		}
+
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in client CA bundle %s", st.ClientCAFile)
+		}
+
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if st.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if st.RequireClientCert {
+		return nil, fmt.Errorf("a client CA bundle is required to verify client certificates")
+	}
+
+	return cfg, nil
+}
+
+// certReloader supplies the certificate for TLS handshakes, reloading
+// it when the modification time of the certificate or key file changes.
+// The files are checked at most once per recheck interval, and the last
+// valid certificate keeps being used if reloading fails.
+type certReloader struct {
+	certFile, keyFile string
+	recheck           time.Duration
+	logger            Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	cert, fresh := c.cert, time.Since(c.checked) < c.recheck
+	c.mu.RUnlock()
+	if fresh {
+		return cert, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// another handshake may have checked the files in the meantime
+	if time.Since(c.checked) < c.recheck {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+
+	if mod, err := c.latestModTime(); err == nil && !mod.Equal(c.modTime) {
+		if err := c.load(mod); err != nil {
+			c.logger.Error("Error reloading TLS certificate", "file", c.certFile, "error", err)
+		} else {
+			c.logger.Info("Reloaded TLS certificate", "file", c.certFile)
+		}
+	}
+
+	return c.cert, nil
+}
+
+func (c *certReloader) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mod, err := c.latestModTime()
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	c.checked = time.Now()
+
+	return c.load(mod)
+}
+
+// load loads the certificate and key, recording the given modification
+// time, even on failure, so that a broken pair is only reported once.
+func (c *certReloader) load(mod time.Time) error {
+	c.modTime = mod
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	c.cert = &cert
+
+	return nil
+}
+
+// latestModTime is the latest modification time of the certificate and key.
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
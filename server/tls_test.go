@@ -0,0 +1,221 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestServerTLS_config(t *testing.T) {
+	pki := newTestPKI(t, "fallback.test")
+
+	tests := []struct {
+		name           string
+		st             ServerTLS
+		wantClientAuth tls.ClientAuthType
+		wantErr        bool
+	}{
+		{name: "basic", st: ServerTLS{CertFile: pki.serverCert, KeyFile: pki.serverKey}, wantClientAuth: tls.NoClientCert},
+		{name: "optional client cert", st: ServerTLS{CertFile: pki.serverCert, KeyFile: pki.serverKey, ClientCAFile: pki.caFile}, wantClientAuth: tls.VerifyClientCertIfGiven},
+		{name: "required client cert", st: ServerTLS{CertFile: pki.serverCert, KeyFile: pki.serverKey, ClientCAFile: pki.caFile, RequireClientCert: true}, wantClientAuth: tls.RequireAndVerifyClientCert},
+		{name: "required client cert without CAs", st: ServerTLS{CertFile: pki.serverCert, KeyFile: pki.serverKey, RequireClientCert: true}, wantErr: true},
+		{name: "missing cert", st: ServerTLS{CertFile: filepath.Join(t.TempDir(), "missing.pem"), KeyFile: pki.serverKey}, wantErr: true},
+		{name: "mismatched key", st: ServerTLS{CertFile: pki.serverCert, KeyFile: pki.clientKey}, wantErr: true},
+		{name: "invalid client CA bundle", st: ServerTLS{CertFile: pki.serverCert, KeyFile: pki.serverKey, ClientCAFile: pki.serverKey}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.st.config(slog.Default())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ServerTLS.config() %s error = %v, wantErr = %v", tt.name, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got.ClientAuth != tt.wantClientAuth {
+				t.Errorf("ServerTLS.config() %s client auth: got = %v, want = %v", tt.name, got.ClientAuth, tt.wantClientAuth)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	first := newTestPKI(t, "first.test")
+	second := newTestPKI(t, "second.test")
+
+	certs := &certReloader{certFile: first.serverCert, keyFile: first.serverKey, logger: slog.Default()}
+	if err := certs.reload(); err != nil {
+		t.Fatalf("certReloader.reload(): %v", err)
+	}
+
+	name := func() string {
+		cert, err := certs.getCertificate(nil)
+		if err != nil {
+			t.Fatalf("certReloader.getCertificate(): %v", err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	// replace the certificate and key with newer files
+	replace := func(cert, key []byte, mod time.Time) {
+		ioutil.WriteFile(first.serverCert, cert, 0600)
+		ioutil.WriteFile(first.serverKey, key, 0600)
+		os.Chtimes(first.serverCert, mod, mod)
+		os.Chtimes(first.serverKey, mod, mod)
+	}
+
+	if got := name(); got != "first.test" {
+		t.Errorf("certReloader.getCertificate(): got = %s, want = %s", got, "first.test")
+	}
+
+	cert, _ := ioutil.ReadFile(second.serverCert)
+	key, _ := ioutil.ReadFile(second.serverKey)
+	replace(cert, key, time.Now().Add(time.Minute))
+	if got := name(); got != "second.test" {
+		t.Errorf("certReloader.getCertificate() reloaded: got = %s, want = %s", got, "second.test")
+	}
+
+	// a broken pair keeps the last valid certificate in use
+	replace(cert, []byte("invalid"), time.Now().Add(2*time.Minute))
+	if got := name(); got != "second.test" {
+		t.Errorf("certReloader.getCertificate() broken: got = %s, want = %s", got, "second.test")
+	}
+
+	// files are not checked again until the recheck interval elapses
+	first = newTestPKI(t, "first.test")
+	certs = &certReloader{certFile: first.serverCert, keyFile: first.serverKey, recheck: time.Hour, logger: slog.Default()}
+	if err := certs.reload(); err != nil {
+		t.Fatalf("certReloader.reload(): %v", err)
+	}
+	replace(cert, key, time.Now().Add(time.Minute))
+	if got := name(); got != "first.test" {
+		t.Errorf("certReloader.getCertificate() before recheck: got = %s, want = %s", got, "first.test")
+	}
+	certs.checked = time.Now().Add(-time.Hour)
+	if got := name(); got != "second.test" {
+		t.Errorf("certReloader.getCertificate() after recheck: got = %s, want = %s", got, "second.test")
+	}
+}
+
+func TestFallbackServer_Start_tls(t *testing.T) {
+	pki := newTestPKI(t, "fallback.test")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	f := NewServer("0", "localhost:1234",
+		WithListener(lis),
+		WithTLS(ServerTLS{
+			CertFile:          pki.serverCert,
+			KeyFile:           pki.serverKey,
+			ClientCAFile:      pki.caFile,
+			RequireClientCert: true,
+		}))
+	if err := f.StartBackground(); err != nil {
+		t.Fatalf("FallbackServer.StartBackground(): unexpected error: %v", err)
+	}
+	t.Cleanup(func() { f.Shutdown(context.Background()) })
+
+	clientCert, err := tls.LoadX509KeyPair(pki.clientCert, pki.clientKey)
+	if err != nil {
+		t.Fatalf("error loading client certificate: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		wantErr bool
+	}{
+		{name: "client certificate", certs: []tls.Certificate{clientCert}},
+		{name: "no client certificate", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						RootCAs:      pki.pool,
+						ServerName:   "fallback.test",
+						Certificates: tt.certs,
+					},
+					ForceAttemptHTTP2: true,
+				},
+				Timeout: 5 * time.Second,
+			}
+
+			req, _ := http.NewRequest(http.MethodOptions, "https://"+lis.Addr().String()+"/$rpc/grpc.health.v1.Health/Check", nil)
+			res, err := client.Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FallbackServer.Start() %s error = %v, wantErr = %v", tt.name, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+				t.Errorf("FallbackServer.Start() %s: got = %d %s, want = %d HTTP/2.0", tt.name, res.StatusCode, res.Proto, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_preStart_h2c(t *testing.T) {
+	f := NewServer("0", "localhost:1234", WithH2C())
+	if err := f.preStart(); err != nil {
+		t.Fatalf("FallbackServer.preStart() h2c: unexpected error: %v", err)
+	}
+
+	s := httptest.NewServer(f.server.Handler)
+	t.Cleanup(s.Close)
+
+	// speak HTTP/2 with prior knowledge over cleartext
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	req, _ := http.NewRequest(http.MethodOptions, s.URL+"/$rpc/grpc.health.v1.Health/Check", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("FallbackServer.preStart() h2c: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		t.Errorf("FallbackServer.preStart() h2c: got = %d %s, want = %d HTTP/2.0", res.StatusCode, res.Proto, http.StatusOK)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+const tracerName = "github.com/googleapis/grpc-fallback-go/server"
+
+// Tracing configures the OpenTelemetry tracing of proxied requests.
+type Tracing struct {
+	// Provider creates the spans of requests, and exports them with the
+	// exporter it is set up with, such as the in-memory exporter of
+	// go.opentelemetry.io/otel/sdk/trace/tracetest. Defaults to the
+	// global TracerProvider.
+	Provider trace.TracerProvider
+
+	// Propagator extracts the trace context of requests from their
+	// headers, and injects it into the metadata of backend calls.
+	// Defaults to DefaultPropagator.
+	Propagator propagation.TextMapPropagator
+}
+
+// DefaultPropagator propagates W3C Trace Context and Baggage, and B3
+// trace context, which is extracted from either single or multiple
+// headers, and injected as a single b3 header.
+func DefaultPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.New(),
+	)
+}
+
+// requestSpan is the span of a request, which is only started once
+// the handler knows the gRPC method the request is proxied to.
+type requestSpan struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	start      time.Time
+	span       trace.Span
+	coded      bool
+}
+
+type spanKey struct{}
+
+// withTracing is middleware ending the span of each request for a gRPC
+// method, once it has been handled. Like their metrics, requests not given
+// a gRPC status by their handler have an OK status, or UNKNOWN if the HTTP
+// status is an error. Other requests, such as those of the health
+// endpoints, are not traced.
+func (f *FallbackServer) withTracing(next http.Handler) http.Handler {
+	provider := f.tracing.Provider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	propagator := f.tracing.Propagator
+	if propagator == nil {
+		propagator = DefaultPropagator()
+	}
+	tracer := provider.Tracer(tracerName)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rs := &requestSpan{tracer: tracer, propagator: propagator, start: time.Now()}
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, rs)))
+		if rs.span == nil {
+			return
+		}
+
+		st := sw.status
+		if st == 0 {
+			st = http.StatusOK
+		}
+		if !rs.coded {
+			code := codes.OK
+			if st >= http.StatusBadRequest {
+				code = codes.Unknown
+			}
+			rs.setCode(code)
+		}
+		rs.span.SetAttributes(semconv.HTTPStatusCode(st))
+		rs.span.End()
+	})
+}
+
+// startSpan starts the span of the request to the given method, as a
+// child of the trace context in the request headers, if it is traced.
+// The returned context carries the span, or is the request's context.
+func startSpan(r *http.Request, method string) context.Context {
+	ctx := r.Context()
+	rs, ok := ctx.Value(spanKey{}).(*requestSpan)
+	if !ok {
+		return ctx
+	}
+
+	service, name := splitMethod(method)
+	ctx = rs.propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, rs.span = rs.tracer.Start(ctx, strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(rs.start),
+		trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCService(service), semconv.RPCMethod(name)))
+
+	return ctx
+}
+
+// injectSpan adds the trace context of the request's span to the outgoing
+// metadata of ctx, replacing any trace headers forwarded as metadata.
+func injectSpan(ctx context.Context, r *http.Request) context.Context {
+	rs, ok := r.Context().Value(spanKey{}).(*requestSpan)
+	if !ok || rs.span == nil {
+		return ctx
+	}
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	for _, k := range rs.propagator.Fields() {
+		delete(md, strings.ToLower(k))
+	}
+	rs.propagator.Inject(ctx, metadataCarrier(md))
+
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// setCode records the gRPC status code of the request on its span,
+// which is marked as failed unless the code is OK.
+func (rs *requestSpan) setCode(code codes.Code) {
+	if rs.span == nil {
+		return
+	}
+
+	rs.coded = true
+	rs.span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if code != codes.OK {
+		rs.span.SetStatus(otelcodes.Error, code.String())
+	}
+}
+
+// metadataCarrier is a propagation.TextMapCarrier of gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if vs := metadata.MD(c).Get(key); len(vs) > 0 {
+		return vs[0]
+	}
+
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// metadataBackend returns a connection to the test health server, and
+// the incoming metadata of the last call it served.
+func metadataBackend(t *testing.T) (connection, func() metadata.MD) {
+	var mu sync.Mutex
+	var last metadata.MD
+
+	cc := testBackend(t, false, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mu.Lock()
+		last, _ = metadata.FromIncomingContext(ctx)
+		mu.Unlock()
+		return handler(ctx, req)
+	}))
+
+	return cc, func() metadata.MD {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+}
+
+func TestFallbackServer_withTracing(t *testing.T) {
+	cc, incoming := metadataBackend(t)
+	exporter := tracetest.NewInMemoryExporter()
+	f := &FallbackServer{
+		cc:      cc,
+		tracing: &Tracing{Provider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))},
+		headers: &HeaderPolicy{Allow: []string{"traceparent"}},
+	}
+
+	r := mux.NewRouter()
+	r.Use(f.withTracing)
+	r.HandleFunc(healthzPath, f.healthz)
+	r.HandleFunc(fallbackPath, f.handler).Headers("Content-Type", protoType)
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	traceID, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	parentID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+
+	tests := []struct {
+		name       string
+		service    string
+		header     http.Header
+		wantHeader string
+		wantStatus otelcodes.Code
+		wantCode   int64
+		wantHTTP   int64
+	}{
+		{
+			name:       "W3C trace context",
+			header:     http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+			wantHeader: "traceparent",
+			wantHTTP:   http.StatusOK,
+		},
+		{
+			name: "B3 trace context",
+			header: http.Header{
+				"X-B3-Traceid": {"0af7651916cd43dd8448eb211c80319c"},
+				"X-B3-Spanid":  {"b7ad6b7169203331"},
+				"X-B3-Sampled": {"1"},
+			},
+			wantHeader: "b3",
+			wantHTTP:   http.StatusOK,
+		},
+		{
+			name:       "error",
+			service:    "error",
+			header:     http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+			wantHeader: "traceparent",
+			wantStatus: otelcodes.Error,
+			wantCode:   5,
+			wantHTTP:   http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		exporter.Reset()
+
+		body, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: tt.service})
+		req, _ := http.NewRequest(http.MethodPost, s.URL+"/$rpc/grpc.health.v1.Health/Check", bytes.NewReader(body))
+		req.Header = tt.header
+		req.Header.Set("Content-Type", protoType)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("withTracing() %s: %v", tt.name, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		spans := exporter.GetSpans()
+		if len(spans) != 1 {
+			t.Fatalf("withTracing() %s: got %d spans, want = 1", tt.name, len(spans))
+		}
+		span := spans[0]
+
+		if span.Name != "grpc.health.v1.Health/Check" {
+			t.Errorf("withTracing() %s name: got = %s, want = grpc.health.v1.Health/Check", tt.name, span.Name)
+		}
+		if span.SpanContext.TraceID() != traceID || span.Parent.SpanID() != parentID {
+			t.Errorf("withTracing() %s parent: got = %s/%s, want = %s/%s", tt.name, span.SpanContext.TraceID(), span.Parent.SpanID(), traceID, parentID)
+		}
+		if span.Status.Code != tt.wantStatus {
+			t.Errorf("withTracing() %s status: got = %v, want = %v", tt.name, span.Status.Code, tt.wantStatus)
+		}
+
+		attrs := attribute.NewSet(span.Attributes...)
+		for k, want := range map[attribute.Key]interface{}{
+			"rpc.system":           "grpc",
+			"rpc.service":          "grpc.health.v1.Health",
+			"rpc.method":           "Check",
+			"rpc.grpc.status_code": tt.wantCode,
+			"http.status_code":     tt.wantHTTP,
+		} {
+			if got, _ := attrs.Value(k); got.AsInterface() != want {
+				t.Errorf("withTracing() %s attribute %s: got = %v, want = %v", tt.name, k, got.AsInterface(), want)
+			}
+		}
+
+		// the backend is called within the span, rather than its parent
+		got := incoming().Get(tt.wantHeader)
+		if len(got) != 1 || !strings.Contains(got[0], span.SpanContext.SpanID().String()) {
+			t.Errorf("withTracing() %s propagated %s: got = %v, want span %s", tt.name, tt.wantHeader, got, span.SpanContext.SpanID())
+		}
+	}
+
+	// only requests for gRPC methods are traced
+	exporter.Reset()
+	if res, err := http.Get(s.URL + healthzPath); err == nil {
+		res.Body.Close()
+	}
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("withTracing() health: got %d spans, want = 0", len(spans))
+	}
+}
+
+func TestMetadataCarrier(t *testing.T) {
+	md := metadata.Pairs("traceparent", "old")
+	c := metadataCarrier(md)
+
+	c.Set("Traceparent", "new")
+	if got := c.Get("traceparent"); got != "new" {
+		t.Errorf("metadataCarrier.Get(): got = %s, want = new", got)
+	}
+	if got := c.Get("b3"); got != "" {
+		t.Errorf("metadataCarrier.Get() missing: got = %s, want = empty", got)
+	}
+	if got := c.Keys(); len(got) != 1 || got[0] != "traceparent" {
+		t.Errorf("metadataCarrier.Keys(): got = %v, want = [traceparent]", got)
+	}
+}
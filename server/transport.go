@@ -0,0 +1,97 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// TransportSecurity configures the security of the connection
+// to the gRPC backend. The zero value uses TLS, verifying the
+// backend's certificate with the system's root CAs.
+type TransportSecurity struct {
+	// Plaintext disables TLS, and cannot be combined
+	// with any of the other settings.
+	Plaintext bool `json:"plaintext,omitempty"`
+
+	// CAFile is a PEM bundle of the CAs trusted to verify
+	// the backend's certificate, instead of the system's.
+	CAFile string `json:"ca_file,omitempty"`
+
+	// CertFile and KeyFile are the PEM certificate and key
+	// presented to the backend for mutual TLS.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// ServerName overrides the name verified in the backend's
+	// certificate, which otherwise is the host of its address.
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// dialOption returns the transport credentials dial option
+// for the security settings.
+func (ts TransportSecurity) dialOption() (grpc.DialOption, error) {
+	if ts.Plaintext {
+		if ts.CAFile != "" || ts.CertFile != "" || ts.KeyFile != "" || ts.ServerName != "" {
+			return nil, errors.New("plaintext backend connections cannot be combined with TLS settings")
+		}
+		return grpc.WithInsecure(), nil
+	}
+
+	cfg, err := ts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
+
+func (ts TransportSecurity) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: ts.ServerName,
+	}
+
+	if ts.CAFile != "" {
+		b, err := ioutil.ReadFile(ts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading backend CA bundle: %v", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in backend CA bundle %s", ts.CAFile)
+		}
+	}
+
+	if (ts.CertFile == "") != (ts.KeyFile == "") {
+		return nil, errors.New("both a client certificate and key are required for mutual TLS")
+	}
+	if ts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(ts.CertFile, ts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
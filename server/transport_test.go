@@ -0,0 +1,185 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testPKI is a CA, along with server and client certificates it issued,
+// written to PEM files.
+type testPKI struct {
+	pool *x509.CertPool
+
+	caFile, serverCert, serverKey, clientCert, clientKey string
+}
+
+// newTestPKI issues certificates valid for the given server name.
+func newTestPKI(t *testing.T, serverName string) *testPKI {
+	dir := t.TempDir()
+	p := &testPKI{pool: x509.NewCertPool()}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("error creating test CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	p.pool.AddCert(ca)
+	p.caFile = writePEM(t, dir, "ca.pem", "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("error creating test certificate: %v", err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+
+		return writePEM(t, dir, name+".pem", "CERTIFICATE", der), writePEM(t, dir, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	}
+	p.serverCert, p.serverKey = issue(serverName, 2, x509.ExtKeyUsageServerAuth)
+	p.clientCert, p.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+
+	return p
+}
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("error writing %s: %v", name, err)
+	}
+
+	return path
+}
+
+func TestTransportSecurity_dialOption(t *testing.T) {
+	pki := newTestPKI(t, "backend.test")
+
+	tests := []struct {
+		name    string
+		ts      TransportSecurity
+		wantErr bool
+	}{
+		{name: "system roots", ts: TransportSecurity{}},
+		{name: "plaintext", ts: TransportSecurity{Plaintext: true}},
+		{name: "custom CA", ts: TransportSecurity{CAFile: pki.caFile, ServerName: "backend.test"}},
+		{name: "mutual TLS", ts: TransportSecurity{CAFile: pki.caFile, CertFile: pki.clientCert, KeyFile: pki.clientKey}},
+		{name: "plaintext with TLS settings", ts: TransportSecurity{Plaintext: true, CAFile: pki.caFile}, wantErr: true},
+		{name: "missing CA bundle", ts: TransportSecurity{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, wantErr: true},
+		{name: "invalid CA bundle", ts: TransportSecurity{CAFile: pki.clientKey}, wantErr: true},
+		{name: "certificate without key", ts: TransportSecurity{CertFile: pki.clientCert}, wantErr: true},
+		{name: "mismatched key", ts: TransportSecurity{CertFile: pki.clientCert, KeyFile: pki.serverKey}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.ts.dialOption()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TransportSecurity.dialOption() %s error = %v, wantErr = %v", tt.name, err, tt.wantErr)
+			}
+			if err == nil && got == nil {
+				t.Errorf("TransportSecurity.dialOption() %s: got no dial option", tt.name)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_dial_mutualTLS(t *testing.T) {
+	pki := newTestPKI(t, "backend.test")
+
+	cert, err := tls.LoadX509KeyPair(pki.serverCert, pki.serverKey)
+	if err != nil {
+		t.Fatalf("error loading server certificate: %v", err)
+	}
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pki.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	dialer := testDialer(testListener(t, false, grpc.Creds(creds)))
+
+	tests := []struct {
+		name    string
+		ts      TransportSecurity
+		wantErr bool
+	}{
+		{name: "client certificate", ts: TransportSecurity{CAFile: pki.caFile, CertFile: pki.clientCert, KeyFile: pki.clientKey, ServerName: "backend.test"}},
+		{name: "no client certificate", ts: TransportSecurity{CAFile: pki.caFile, ServerName: "backend.test"}, wantErr: true},
+		{name: "wrong server name", ts: TransportSecurity{CAFile: pki.caFile, CertFile: pki.clientCert, KeyFile: pki.clientKey, ServerName: "other.test"}, wantErr: true},
+		{name: "plaintext", ts: TransportSecurity{Plaintext: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{
+				backend:   "bufnet",
+				transport: &tt.ts,
+				dialOpts:  []grpc.DialOption{dialer},
+			}
+			cc, err := f.dial()
+			if err != nil {
+				t.Fatalf("FallbackServer.dial() %s: %v", tt.name, err)
+			}
+			defer cc.(*grpc.ClientConn).Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			res := &healthpb.HealthCheckResponse{}
+			err = cc.Invoke(ctx, "/grpc.health.v1.Health/Check", &healthpb.HealthCheckRequest{}, res)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FallbackServer.dial() %s invoke error = %v, wantErr = %v", tt.name, err, tt.wantErr)
+			}
+			if err == nil && res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+				t.Errorf("FallbackServer.dial() %s: got = %v, want = %v", tt.name, res.GetStatus(), healthpb.HealthCheckResponse_SERVING)
+			}
+		})
+	}
+}
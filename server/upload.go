@@ -0,0 +1,158 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// maxRequestMessageSize bounds the size of a single message
+// in a length-delimited request body.
+const maxRequestMessageSize = 64 << 20
+
+// requestReader reads the messages of a streamed request body, one at a time.
+type requestReader interface {
+	// next returns the next request message in the protobuf binary
+	// format, or io.EOF once the body has been consumed.
+	next() ([]byte, error)
+}
+
+// clientStream proxies a client-streaming RPC, sending each request message
+// to the backend as soon as it has been read from the request body. Once the
+// body has been consumed, the single response message is written, or for
+// methods that are also server-streaming, the framed response stream.
+func (f *FallbackServer) clientStream(ctx context.Context, w http.ResponseWriter, r *http.Request, method string, md protoreflect.MethodDescriptor, rr requestReader, fr streamFramer) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	desc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: md.IsStreamingServer()}
+	stream, err := f.cc.NewStream(ctx, desc, method)
+	if err != nil {
+		fr.fail(w, r, err)
+		return
+	}
+
+	// the deferred cancel abandons a partially sent RPC
+	if err := sendRequests(stream, rr); err != nil {
+		fr.fail(w, r, err)
+		return
+	}
+
+	if md.IsStreamingServer() {
+		f.relayResponses(w, r, stream, fr)
+		return
+	}
+
+	// the trailer metadata is available once the single response
+	// has been received, as the RPC is complete by then
+	res := &bytes.Buffer{}
+	err = stream.RecvMsg(res)
+	header, _ := stream.Header()
+	f.writeHeaderMetadata(w, header, stream.Trailer())
+	defer f.writeTrailerMetadata(w, stream.Trailer(), false)
+	if err != nil {
+		fr.fail(w, r, err)
+		return
+	}
+
+	if err := fr.single(w, res.Bytes()); err != nil {
+		fr.fail(w, r, err)
+	}
+}
+
+// sendRequests sends each message read from the request body on the stream,
+// and then closes the sending side. Errors reading the body are returned,
+// while a failed send surfaces as an error on the first receive.
+func sendRequests(stream grpc.ClientStream, rr requestReader) error {
+	for {
+		req, err := rr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := stream.SendMsg(bytes.NewReader(req)); err != nil {
+			break
+		}
+	}
+	stream.CloseSend()
+
+	return nil
+}
+
+// delimitedReader reads protobuf binary messages,
+// each prefixed by its length as a varint.
+type delimitedReader struct {
+	r *bufio.Reader
+}
+
+func newDelimitedReader(r io.Reader) *delimitedReader {
+	return &delimitedReader{r: bufio.NewReader(r)}
+}
+
+func (d *delimitedReader) next() ([]byte, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "error reading request message length: %v", err)
+	}
+	if n > maxRequestMessageSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "request message of %d bytes exceeds the limit of %d bytes", n, maxRequestMessageSize)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "error reading request message: %v", err)
+	}
+
+	return b, nil
+}
+
+// ndjsonReader reads proto3 JSON messages separated by whitespace,
+// typically newlines, and transcodes them to the protobuf binary format.
+type ndjsonReader struct {
+	dec *json.Decoder
+	md  protoreflect.MessageDescriptor
+}
+
+func newNDJSONReader(r io.Reader, md protoreflect.MessageDescriptor) *ndjsonReader {
+	return &ndjsonReader{dec: json.NewDecoder(r), md: md}
+}
+
+func (n *ndjsonReader) next() ([]byte, error) {
+	var raw json.RawMessage
+	if err := n.dec.Decode(&raw); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid JSON request message: %v", err)
+	}
+
+	return decodeJSON(n.md, raw)
+}
@@ -0,0 +1,293 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+)
+
+// testUploadServer implements the streaming methods of the gRPC interop
+// test service. StreamingInputCall fails if any payload is "fail", and
+// FullDuplexCall echoes each payload until a request carries a status.
+type testUploadServer struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (testUploadServer) StreamingInputCall(stream testpb.TestService_StreamingInputCallServer) error {
+	size := 0
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&testpb.StreamingInputCallResponse{AggregatedPayloadSize: int32(size)})
+		}
+		if err != nil {
+			return err
+		}
+
+		if string(req.GetPayload().GetBody()) == "fail" {
+			return status.Error(codes.FailedPrecondition, "failed")
+		}
+		size += len(req.GetPayload().GetBody())
+	}
+}
+
+func (testUploadServer) FullDuplexCall(stream testpb.TestService_FullDuplexCallServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if st := req.GetResponseStatus(); st != nil {
+			return status.Error(codes.Code(st.GetCode()), st.GetMessage())
+		}
+		if err := stream.Send(&testpb.StreamingOutputCallResponse{Payload: req.GetPayload()}); err != nil {
+			return err
+		}
+	}
+}
+
+// delimited encodes the given messages as a length-delimited request body.
+func delimited(msgs ...proto.Message) []byte {
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		b, _ := proto.Marshal(m)
+		n := make([]byte, binary.MaxVarintLen64)
+		buf.Write(n[:binary.PutUvarint(n, uint64(len(b)))])
+		buf.Write(b)
+	}
+
+	return buf.Bytes()
+}
+
+// marshal encodes the given message as a single message request body.
+func marshal(m proto.Message) []byte {
+	b, _ := proto.Marshal(m)
+	return b
+}
+
+func inputRequest(body string) *testpb.StreamingInputCallRequest {
+	return &testpb.StreamingInputCallRequest{Payload: &testpb.Payload{Body: []byte(body)}}
+}
+
+func TestFallbackServer_clientStream_proto(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        []byte
+		wantCode    int
+		wantSize    int32
+		wantStatus  codes.Code
+	}{
+		{
+			name:     "basic",
+			body:     delimited(inputRequest("a"), inputRequest("bb"), inputRequest("ccc")),
+			wantCode: http.StatusOK,
+			wantSize: 6,
+		},
+		{
+			name:     "empty body",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:       "truncated message",
+			body:       delimited(inputRequest("abc"))[:3],
+			wantCode:   http.StatusBadRequest,
+			wantStatus: codes.InvalidArgument,
+		},
+		{
+			name:       "oversized message",
+			body:       []byte{0xff, 0xff, 0xff, 0xff, 0x0f},
+			wantCode:   http.StatusTooManyRequests,
+			wantStatus: codes.ResourceExhausted,
+		},
+		{
+			name:       "backend error",
+			body:       delimited(inputRequest("a"), inputRequest("fail")),
+			wantCode:   http.StatusPreconditionFailed,
+			wantStatus: codes.FailedPrecondition,
+		},
+		{
+			name:        "single message",
+			contentType: protoType,
+			body:        marshal(inputRequest("abcd")),
+			wantCode:    http.StatusOK,
+			wantSize:    4,
+		},
+		{
+			name:       "unresolved method",
+			method:     "foo.Bar/Baz",
+			body:       delimited(inputRequest("a")),
+			wantCode:   http.StatusPreconditionFailed,
+			wantStatus: codes.FailedPrecondition,
+		},
+		{
+			name:       "not client-streaming",
+			method:     "grpc.testing.TestService/UnaryCall",
+			body:       delimited(inputRequest("a")),
+			wantCode:   http.StatusBadRequest,
+			wantStatus: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, ct := tt.method, tt.contentType
+			if method == "" {
+				method = "grpc.testing.TestService/StreamingInputCall"
+			}
+			if ct == "" {
+				ct = protoStreamType
+			}
+
+			f := &FallbackServer{cc: testBackend(t, false)}
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.handler)
+
+			req := httptest.NewRequest(http.MethodPost, "/$rpc/"+method, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", ct)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.wantCode {
+				t.Fatalf("clientStream() %s code: got = %d, want = %d", tt.name, resp.Code, tt.wantCode)
+			}
+
+			if resp.Code != http.StatusOK {
+				st := &statuspb.Status{}
+				if err := proto.Unmarshal(resp.Body.Bytes(), st); err != nil || codes.Code(st.GetCode()) != tt.wantStatus {
+					t.Errorf("clientStream() %s status: got = %v (%v), want = %v", tt.name, st, err, tt.wantStatus)
+				}
+				return
+			}
+
+			res := &testpb.StreamingInputCallResponse{}
+			if err := proto.Unmarshal(resp.Body.Bytes(), res); err != nil || res.GetAggregatedPayloadSize() != tt.wantSize {
+				t.Errorf("clientStream() %s: got = %v (%v), want = %d", tt.name, res, err, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestFallbackServer_clientStream_bidi(t *testing.T) {
+	f := &FallbackServer{cc: testBackend(t, false)}
+	r := mux.NewRouter()
+	r.HandleFunc(fallbackPath, f.handler)
+
+	body := delimited(
+		&testpb.StreamingOutputCallRequest{Payload: &testpb.Payload{Body: []byte("a")}},
+		&testpb.StreamingOutputCallRequest{Payload: &testpb.Payload{Body: []byte("b")}},
+		&testpb.StreamingOutputCallRequest{ResponseStatus: &testpb.EchoStatus{Code: int32(codes.Aborted), Message: "done"}},
+	)
+	req := httptest.NewRequest(http.MethodPost, "/$rpc/grpc.testing.TestService/FullDuplexCall", bytes.NewReader(body))
+	req.Header.Set("Content-Type", protoStreamType)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("clientStream() bidi code: got = %d, want = %d", resp.Code, http.StatusOK)
+	}
+
+	frames := readFrames(t, resp.Body.Bytes())
+	if len(frames) != 3 {
+		t.Fatalf("clientStream() bidi: got = %d frames, want = %d", len(frames), 3)
+	}
+
+	for i, want := range []string{"a", "b"} {
+		res := &testpb.StreamingOutputCallResponse{}
+		if frames[i].flag != messageFrame || proto.Unmarshal(frames[i].data, res) != nil || string(res.GetPayload().GetBody()) != want {
+			t.Errorf("clientStream() bidi frame %d: got = %v, want = %s", i, frames[i], want)
+		}
+	}
+
+	st := &statuspb.Status{}
+	if frames[2].flag != statusFrame || proto.Unmarshal(frames[2].data, st) != nil || codes.Code(st.GetCode()) != codes.Aborted {
+		t.Errorf("clientStream() bidi status frame: got = %v, want = %v", frames[2], codes.Aborted)
+	}
+}
+
+func TestFallbackServer_clientStream_json(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "basic",
+			method:   "StreamingInputCall",
+			body:     "{\"payload\":{\"body\":\"YQ==\"}}\n{\"payload\":{\"body\":\"YmI=\"}}\n",
+			wantCode: http.StatusOK,
+			wantBody: `{"aggregatedPayloadSize":3}`,
+		},
+		{
+			name:     "invalid message",
+			method:   "StreamingInputCall",
+			body:     "{\"payload\":{\"body\":\"YQ==\"}}\n{\"unknown\":1}\n",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "malformed JSON",
+			method:   "StreamingInputCall",
+			body:     "{\"payload\":",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "bidi",
+			method:   "FullDuplexCall",
+			body:     "{\"payload\":{\"body\":\"YQ==\"}}\n{}\n",
+			wantCode: http.StatusOK,
+			wantBody: `[{"result":{"payload":{"body":"YQ=="}}},{"result":{}},{"status":{}}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FallbackServer{cc: testBackend(t, false)}
+			r := mux.NewRouter()
+			r.HandleFunc(fallbackPath, f.jsonHandler)
+
+			req := httptest.NewRequest(http.MethodPost, "/$rpc/grpc.testing.TestService/"+tt.method, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", jsonType)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.wantCode {
+				t.Errorf("clientStream() %s code: got = %d, want = %d", tt.name, resp.Code, tt.wantCode)
+			}
+
+			if tt.wantBody != "" && compactJSON(resp.Body.String()) != tt.wantBody {
+				t.Errorf("clientStream() %s body: got = %s, want = %s", tt.name, resp.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -15,13 +15,11 @@
 package server
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
 )
 
 // httpStatusFromCode converts a gRPC error code into the corresponding HTTP response status.
@@ -73,23 +71,13 @@ func buildMethod(service, method string) string {
 	return fmt.Sprintf("/%s/%s", service, method)
 }
 
-func prepareHeaders(ctx context.Context, hdr http.Header) context.Context {
-	out, ok := metadata.FromOutgoingContext(ctx)
-	if !ok {
-		out = metadata.MD{}
+// splitMethod splits a method built by buildMethod
+// into its service and method names.
+func splitMethod(m string) (string, string) {
+	m = strings.TrimPrefix(m, "/")
+	if i := strings.LastIndex(m, "/"); i >= 0 {
+		return m[:i], m[i+1:]
 	}
 
-	// copy Authorization header
-	if auth := hdr.Get("Authorization"); auth != "" {
-		out.Set("authorization", auth)
-	}
-
-	// keep x-goog-* headers
-	for key, val := range hdr {
-		if strings.HasPrefix(strings.ToLower(key), "x-goog-") {
-			out.Set(key, val...)
-		}
-	}
-
-	return metadata.NewOutgoingContext(ctx, out)
+	return "", m
 }
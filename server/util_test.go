@@ -14,14 +14,7 @@
 
 package server
 
-import (
-	"context"
-	"net/http"
-	"reflect"
-	"testing"
-
-	"google.golang.org/grpc/metadata"
-)
+import "testing"
 
 func Test_buildMethod(t *testing.T) {
 	type args struct {
@@ -44,43 +37,20 @@ func Test_buildMethod(t *testing.T) {
 	}
 }
 
-func Test_prepareHeaders(t *testing.T) {
-	type args struct {
-		ctx context.Context
-		hdr http.Header
-	}
-
-	parent := context.Background()
-	hdr := make(http.Header)
-	hdr.Add("Content-Type", "test")
-	hdr.Add("accept-encoding", "blah")
-	hdr.Add("content-length", "7")
-	hdr.Add("user-agent", "whoever")
-	hdr.Add("Authorization", "Bearer foo")
-	hdr.Add("x-goog-api-key", "bar")
-
-	want := map[string][]string{
-		"authorization":  []string{"Bearer foo"},
-		"x-goog-api-key": []string{"bar"},
-	}
-
+func Test_splitMethod(t *testing.T) {
 	tests := []struct {
-		name string
-		args args
-		want map[string][]string
+		m           string
+		wantService string
+		wantMethod  string
 	}{
-		{name: "basic", want: want, args: args{hdr: hdr, ctx: parent}},
+		{m: "/foo.Bar/Baz", wantService: "foo.Bar", wantMethod: "Baz"},
+		{m: buildMethod("foo", "bar"), wantService: "foo", wantMethod: "bar"},
+		{m: "Baz", wantMethod: "Baz"},
 	}
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ctx := prepareHeaders(tt.args.ctx, tt.args.hdr)
-			got, _ := metadata.FromOutgoingContext(ctx)
-			for k, v := range tt.want {
-				if !reflect.DeepEqual(got[k], v) {
-					t.Errorf("prepareHeaders() = got[%s]: %v, want[%s]: %v", k, got[k], k, tt.want[k])
-					return
-				}
-			}
-		})
+		service, method := splitMethod(tt.m)
+		if service != tt.wantService || method != tt.wantMethod {
+			t.Errorf("splitMethod(%q): got = %s, %s, want = %s, %s", tt.m, service, method, tt.wantService, tt.wantMethod)
+		}
 	}
 }
@@ -0,0 +1,89 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc"
+)
+
+// virtualHost is a host whose requests are proxied
+// by a FallbackServer of its own.
+type virtualHost struct {
+	host    string
+	backend string
+	opts    []Option
+
+	// server is created when the parent server starts,
+	// so that it inherits the parent's final settings
+	server *FallbackServer
+}
+
+// virtualHost creates the server of the virtual host, with the settings
+// of f that are not overridden by the options of the host.
+func (f *FallbackServer) virtualHost(vh *virtualHost) *FallbackServer {
+	s := &FallbackServer{
+		backend:       vh.backend,
+		dialOpts:      append([]grpc.DialOption{}, f.dialOpts...),
+		transport:     f.transport,
+		sources:       append([]DescriptorSource{}, f.sources...),
+		reflection:    f.reflection,
+		reflectionTTL: f.reflectionTTL,
+		rest:          f.rest,
+		logger:        f.logger,
+		cors:          f.cors,
+		headers:       f.headers,
+		respMetadata:  f.respMetadata,
+		deadlines:     f.deadlines,
+	}
+	for _, opt := range vh.opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// match is a mux.MatcherFunc reporting whether the request is for the
+// virtual host, by its Host header, or by the server name indicated via
+// TLS if it has none. Ports are ignored.
+func (vh *virtualHost) match(r *http.Request, _ *mux.RouteMatch) bool {
+	host := r.Host
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return matchHost(vh.host, host)
+}
+
+// matchHost reports whether the host name matches the pattern, which is
+// either a host name, or a host name with a leading "*." wildcard that
+// matches any number of labels. Names are compared case-insensitively.
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+
+	return host == pattern
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func Test_matchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "foo.example.test", host: "foo.example.test", want: true},
+		{pattern: "foo.example.test", host: "FOO.Example.test.", want: true},
+		{pattern: "foo.example.test", host: "bar.example.test"},
+		{pattern: "foo.example.test", host: "foo.example.test.evil.test"},
+		{pattern: "*.example.test", host: "foo.example.test", want: true},
+		{pattern: "*.example.test", host: "a.b.example.test", want: true},
+		{pattern: "*.example.test", host: "example.test"},
+		{pattern: "*.example.test", host: "fooexample.test"},
+		{pattern: "*.example.test", host: ".example.test"},
+	}
+	for _, tt := range tests {
+		if got := matchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHost(%q, %q): got = %v, want = %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestVirtualHost_match(t *testing.T) {
+	vh := &virtualHost{host: "foo.example.test"}
+
+	tests := []struct {
+		name string
+		host string
+		sni  string
+		want bool
+	}{
+		{name: "host", host: "foo.example.test", want: true},
+		{name: "host with port", host: "foo.example.test:8443", want: true},
+		{name: "other host", host: "bar.example.test"},
+		{name: "host over SNI", host: "bar.example.test", sni: "foo.example.test"},
+		{name: "SNI without host", sni: "foo.example.test", want: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/test", nil)
+		r.Host = tt.host
+		if tt.sni != "" {
+			r.TLS = &tls.ConnectionState{ServerName: tt.sni}
+		}
+
+		if got := vh.match(r, nil); got != tt.want {
+			t.Errorf("virtualHost.match() %s: got = %v, want = %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFallbackServer_virtualHost(t *testing.T) {
+	cors := CORSPolicy{AllowedOrigins: []string{"https://foo.example.test"}}
+	headers := HeaderPolicy{Allow: []string{"x-tenant"}}
+	f := NewServer("0", "localhost:1234",
+		WithLogger(slog.New(slog.NewTextHandler(ioutil.Discard, nil))),
+		WithHeaderPolicy(headers),
+		WithRESTRoutes(),
+		WithVirtualHost("foo.example.test", "localhost:2000", WithCORSPolicy(cors)))
+
+	got := f.virtualHost(f.vhosts[0])
+	if got.backend != "localhost:2000" {
+		t.Errorf("FallbackServer.virtualHost() backend: got = %s, want = localhost:2000", got.backend)
+	}
+	if got.cors == nil || got.cors.AllowedOrigins[0] != "https://foo.example.test" {
+		t.Errorf("FallbackServer.virtualHost() cors: got = %v, want = %v", got.cors, cors)
+	}
+	if got.headers != f.headers || got.logger != f.logger || !got.rest {
+		t.Errorf("FallbackServer.virtualHost() inherited: got = %v, %v, %v, want = %v, %v, true", got.headers, got.logger, got.rest, f.headers, f.logger)
+	}
+	if f.cors != nil {
+		t.Errorf("FallbackServer.virtualHost() parent cors: got = %v, want = nil", f.cors)
+	}
+}
+
+func TestFallbackServer_virtualHosts(t *testing.T) {
+	// the backends report different serving statuses, and are
+	// dialed in memory by their names
+	listeners := make(map[string]*bufconn.Listener)
+	for name, st := range map[string]healthpb.HealthCheckResponse_ServingStatus{
+		"foo": healthpb.HealthCheckResponse_SERVING,
+		"bar": healthpb.HealthCheckResponse_NOT_SERVING,
+	} {
+		hs := health.NewServer()
+		hs.SetServingStatus("", st)
+		s := grpc.NewServer()
+		healthpb.RegisterHealthServer(s, hs)
+		listeners[name] = serveTestServer(t, s)
+	}
+	dialer := grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return listeners[addr].Dial()
+	})
+
+	f := NewServer("0", "",
+		WithDialOptions(dialer, grpc.WithInsecure()),
+		WithVirtualHost("foo.example.test", "foo", WithCORSPolicy(CORSPolicy{AllowedOrigins: []string{"https://app.test"}})),
+		WithVirtualHost("*.bar.example.test", "bar"))
+	if err := f.preStart(); err != nil {
+		t.Fatalf("virtualHosts(): unexpected error: %v", err)
+	}
+	s := httptest.NewServer(f.server.Handler)
+	defer s.Close()
+
+	tests := []struct {
+		name       string
+		host       string
+		wantStatus int
+		want       healthpb.HealthCheckResponse_ServingStatus
+		wantOrigin string
+	}{
+		{name: "foo", host: "foo.example.test", wantStatus: http.StatusOK, want: healthpb.HealthCheckResponse_SERVING},
+		{name: "bar", host: "api.bar.example.test:443", wantStatus: http.StatusOK, want: healthpb.HealthCheckResponse_NOT_SERVING, wantOrigin: "*"},
+		{name: "unknown host", host: "baz.example.test", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		body, _ := proto.Marshal(&healthpb.HealthCheckRequest{})
+		req, _ := http.NewRequest(http.MethodPost, s.URL+"/$rpc/grpc.health.v1.Health/Check", bytes.NewReader(body))
+		req.Host = tt.host
+		req.Header.Set("Content-Type", protoType)
+		req.Header.Set("Origin", "https://other.test")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("virtualHosts() %s: %v", tt.name, err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tt.wantStatus {
+			t.Errorf("virtualHosts() %s: got status = %d, want = %d", tt.name, res.StatusCode, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+
+		// only the CORS policy of foo rejects the origin
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("virtualHosts() %s origin: got = %q, want = %q", tt.name, got, tt.wantOrigin)
+		}
+
+		got := &healthpb.HealthCheckResponse{}
+		if err := proto.Unmarshal(b, got); err != nil {
+			t.Fatalf("virtualHosts() %s: invalid response %q: %v", tt.name, b, err)
+		}
+		if got.GetStatus() != tt.want {
+			t.Errorf("virtualHosts() %s: got = %v, want = %v", tt.name, got.GetStatus(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	websocketPath = "/$ws/{service:[.a-zA-Z0-9]+}/{method:[a-zA-Z]+}"
+
+	// websocketCloseTimeout bounds the time spent sending the close frame.
+	websocketCloseTimeout = time.Second
+)
+
+// upgrader returns a WebSocket upgrader accepting requests from the
+// origins allowed by the CORS policy, as browsers leave the origin
+// checks of WebSockets to the server. Requests without an origin do
+// not come from browsers and are always accepted.
+func (f *FallbackServer) upgrader() *websocket.Upgrader {
+	p := f.corsPolicy()
+
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || p.allowed(origin)
+		},
+	}
+}
+
+// websocketHandler proxies a streaming RPC of any kind over a WebSocket.
+// Each binary frame sent by the client is a protobuf binary request message,
+// and each response message is sent back in a binary frame. A text frame from
+// the client half-closes the request stream. The terminal status is sent as a
+// JSON google.rpc.Status in a text frame, followed by a close frame. The RPC is
+// cancelled if the client closes the WebSocket, or goes away, before then.
+func (f *FallbackServer) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	logger(r).Debug("Incoming grpc-fallback websocket request", "uri", r.RequestURI)
+	v := mux.Vars(r)
+
+	// fail fast on methods the backend is known not to serve
+	if _, err := f.findMethod(v["service"], v["method"]); f.descriptors != nil && status.Code(err) == codes.NotFound {
+		writeError(w, r, err)
+		return
+	}
+
+	// copy headers of the upgrade request into out-going context metadata
+	m := buildMethod(v["service"], v["method"])
+	ctx, cancel, err := f.requestContext(r, m)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	// the upgrader responds with an HTTP error itself
+	conn, err := f.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		logger(r).Debug("Error upgrading request", "uri", r.RequestURI, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	stream, err := f.cc.NewStream(ctx, desc, m)
+	if err != nil {
+		closeWebsocket(conn, r, status.Convert(err))
+		return
+	}
+
+	go relayRequests(ctx, cancel, conn, stream)
+
+	for {
+		res := &bytes.Buffer{}
+		if err := stream.RecvMsg(res); err != nil {
+			closeWebsocket(conn, r, streamStatus(err))
+			return
+		}
+
+		if err := conn.WriteMessage(websocket.BinaryMessage, res.Bytes()); err != nil {
+			logger(r).Debug("Error writing response stream", "uri", r.RequestURI, "error", err)
+			return
+		}
+	}
+}
+
+// relayRequests sends each binary frame read from the WebSocket to the
+// backend, until the client half-closes the stream with a text frame.
+// The RPC is cancelled once the WebSocket is closed.
+func relayRequests(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn, stream grpc.ClientStream) {
+	defer cancel()
+
+	sending := true
+	for {
+		typ, b, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// keep reading after the request stream has ended,
+		// in order to notice the client going away
+		if !sending {
+			continue
+		}
+
+		if typ == websocket.TextMessage {
+			sending = false
+			stream.CloseSend()
+			continue
+		}
+
+		// a failed send surfaces as an error on the next receive
+		if err := stream.SendMsg(bytes.NewReader(b)); err != nil {
+			sending = false
+		}
+	}
+}
+
+// closeWebsocket sends the terminal status of the RPC, and closes the WebSocket.
+func closeWebsocket(conn *websocket.Conn, r *http.Request, st *status.Status) {
+	recordCode(r, st.Code())
+	if st.Code() != codes.OK {
+		logger(r).Debug("Error in websocket stream", "uri", r.RequestURI, "error", st.Err())
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, jsonStatus(st)); err != nil {
+		logger(r).Debug("Error writing response stream status", "uri", r.RequestURI, "error", err)
+		return
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(websocketCloseTimeout))
+}
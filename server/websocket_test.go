@@ -0,0 +1,164 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+func TestFallbackServer_websocketHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		cc         connection
+		sources    []DescriptorSource
+		cors       *CORSPolicy
+		origin     string
+		path       string
+		reqs       []proto.Message
+		wantCode   int
+		wantResps  int
+		wantStatus string
+	}{
+		{
+			name:       "bidi",
+			path:       "/$ws/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+			reqs:       []proto.Message{&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}}, &rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}}},
+			wantResps:  2,
+			wantStatus: `{}`,
+		},
+		{
+			name:       "server streaming",
+			path:       "/$ws/grpc.health.v1.Health/Watch",
+			reqs:       []proto.Message{&healthpb.HealthCheckRequest{}},
+			wantResps:  2,
+			wantStatus: `{}`,
+		},
+		{
+			name:       "error after responses",
+			path:       "/$ws/grpc.health.v1.Health/Watch",
+			reqs:       []proto.Message{&healthpb.HealthCheckRequest{Service: "fail"}},
+			wantResps:  2,
+			wantStatus: `{"code":13,"message":"failed"}`,
+		},
+		{
+			name:       "stream error",
+			cc:         &testConnection{},
+			path:       "/$ws/grpc.health.v1.Health/Watch",
+			wantStatus: `{"code":12,"message":"streamingisnotsupportedbytestConnection"}`,
+		},
+		{
+			name:     "unknown method",
+			sources:  []DescriptorSource{&testSource{err: status.Error(codes.NotFound, "unknown")}},
+			path:     "/$ws/grpc.health.v1.Health/Watch",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "disallowed origin",
+			cors:     &CORSPolicy{AllowedOrigins: []string{"https://*.example.com"}},
+			origin:   "https://evil.com",
+			path:     "/$ws/grpc.health.v1.Health/Watch",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:       "allowed origin",
+			cors:       &CORSPolicy{AllowedOrigins: []string{"https://*.example.com"}},
+			origin:     "https://app.example.com",
+			path:       "/$ws/grpc.health.v1.Health/Watch",
+			reqs:       []proto.Message{&healthpb.HealthCheckRequest{}},
+			wantResps:  2,
+			wantStatus: `{}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := tt.cc
+			if cc == nil {
+				cc = testBackend(t, true)
+			}
+			f := &FallbackServer{cc: cc, cors: tt.cors}
+			if len(tt.sources) > 0 {
+				f.descriptors = multiSource(tt.sources)
+			}
+
+			r := mux.NewRouter()
+			r.HandleFunc(websocketPath, f.websocketHandler)
+			s := httptest.NewServer(r)
+			defer s.Close()
+
+			hdr := make(http.Header)
+			if tt.origin != "" {
+				hdr.Set("Origin", tt.origin)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+tt.path, hdr)
+			if tt.wantCode != 0 {
+				if err == nil || resp == nil || resp.StatusCode != tt.wantCode {
+					t.Errorf("websocketHandler() %s: got = %v (%v), want = %d", tt.name, resp, err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("websocketHandler() %s: error dialing: %v", tt.name, err)
+			}
+			defer conn.Close()
+
+			for _, req := range tt.reqs {
+				b, _ := proto.Marshal(req)
+				if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+					t.Fatalf("websocketHandler() %s: error sending request: %v", tt.name, err)
+				}
+			}
+
+			// half-close the request stream
+			if err := conn.WriteMessage(websocket.TextMessage, nil); err != nil {
+				t.Fatalf("websocketHandler() %s: error closing request stream: %v", tt.name, err)
+			}
+
+			resps := 0
+			for {
+				typ, b, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatalf("websocketHandler() %s: error reading response: %v", tt.name, err)
+				}
+				if typ == websocket.TextMessage {
+					if got := compactJSON(string(b)); got != tt.wantStatus {
+						t.Errorf("websocketHandler() %s status: got = %s, want = %s", tt.name, got, tt.wantStatus)
+					}
+					break
+				}
+				resps++
+			}
+
+			if resps != tt.wantResps {
+				t.Errorf("websocketHandler() %s: got = %d responses, want = %d", tt.name, resps, tt.wantResps)
+			}
+
+			if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("websocketHandler() %s close: got = %v, want = %d", tt.name, err, websocket.CloseNormalClosure)
+			}
+		})
+	}
+}